@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// With AUTO_DISABLE_USERS a user whose refresh token Azure AD rejects is disabled here as well when Graph
+// reports the account disabled or gone, which needs the User.Read.All application permission
+
+var autoDisableUsers = getenvDefault("AUTO_DISABLE_USERS", "") == "true"
+
+// refreshRejected tells the webhooks that Azure AD did not accept the refresh token of the user
+// and disables the user when the account was disabled in Azure AD
+func refreshRejected(ctx context.Context, user *User) {
+	notifyWebhooks(ctx, webhookRefreshFailed, *user)
+	if !autoDisableUsers || user.AzureId == "" {
+		return
+	}
+
+	log := loggerFromContext(ctx).With("user_id", user.ID)
+	enabled, err := accountEnabled(ctx, user.AzureId)
+	if err != nil {
+		log.Warn("Can not check whether the account is enabled", "error", err)
+		return
+	}
+	if enabled {
+		return
+	}
+	user.SetStatus(ctx, userDisabled)
+	audit(ctx, AuditEvent{Event: auditUserDisabled, Reason: "account disabled in Azure AD", UserId: user.ID, AzureId: user.AzureId})
+	log.Info("Disabled user, the account is disabled in Azure AD")
+}
+
+// accountEnabled reads accountEnabled of the user from Graph, a user deleted in Azure AD counts as disabled
+func accountEnabled(ctx context.Context, azureId string) (bool, error) {
+	response, err := appGraphRequest(ctx, "users/accountEnabled", "GET",
+		fmt.Sprint("/v1.0/users/", url.PathEscape(azureId), "?$select=accountEnabled"), nil)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("ERROR: Graph returned %d", response.StatusCode)
+	}
+
+	var result struct {
+		AccountEnabled *bool `json:"accountEnabled"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	if result.AccountEnabled == nil {
+		return false, fmt.Errorf("ERROR: Graph returned no accountEnabled")
+	}
+	return *result.AccountEnabled, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Admin API for operators, authenticated by ADMIN_API_KEY or by the public token of a member of the
+// Azure AD group ADMIN_GROUP_ID. Without either the routes are not registered.
+
+const (
+	adminMembershipTtl = 5 * time.Minute
+	maxAdminPageSize   = 200
+)
+
+var (
+	adminAPIKey  = getenvDefault("ADMIN_API_KEY", "")
+	adminGroupId = getenvDefault("ADMIN_GROUP_ID", "")
+
+	adminMemberships = &membershipCache{members: map[string]cachedMembership{}}
+)
+
+type adminKey struct{}
+
+// userProfile is a user as the admin API and the data export show it, without the tokens
+type userProfile struct {
+	Id             uint       `json:"id"`
+	AzureId        string     `json:"azure_id"`
+	Name           string     `json:"name"`
+	Email          string     `json:"email"`
+	Status         string     `json:"status"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	LastLoginAt    *time.Time `json:"last_login_at"`
+	HasAzureTokens bool       `json:"has_azure_tokens"`
+	Sessions       []Session  `json:"sessions,omitempty"`
+}
+
+func newUserProfile(user User) userProfile {
+	return userProfile{
+		Id:             user.ID,
+		AzureId:        user.AzureId,
+		Name:           user.Name,
+		Email:          user.Email,
+		Status:         user.Status,
+		CreatedAt:      user.CreatedAt,
+		UpdatedAt:      user.UpdatedAt,
+		LastLoginAt:    user.LastLoginAt,
+		HasAzureTokens: user.AccessToken != "" || user.RefreshToken != "",
+	}
+}
+
+type cachedMembership struct {
+	member    bool
+	expiresAt time.Time
+}
+
+// membershipCache remembers the group membership of admins for adminMembershipTtl,
+// so that the admin API does not call Graph on every request
+type membershipCache struct {
+	mu      sync.Mutex
+	members map[string]cachedMembership
+}
+
+func (cache *membershipCache) IsMember(ctx context.Context, azureId string) (bool, error) {
+	cache.mu.Lock()
+	cached, ok := cache.members[azureId]
+	cache.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.member, nil
+	}
+
+	member, err := checkGroupMembership(ctx, azureId, adminGroupId)
+	if err != nil {
+		return false, err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.members[azureId] = cachedMembership{member: member, expiresAt: time.Now().Add(adminMembershipTtl)}
+	return member, nil
+}
+
+// checkGroupMembership asks Graph with the app-only token whether the user is a member of the group,
+// transitively, which needs the GroupMember.Read.All application permission
+func checkGroupMembership(ctx context.Context, azureId, groupId string) (bool, error) {
+	body, err := json.Marshal(map[string][]string{"groupIds": {groupId}})
+	handleError(err)
+	response, err := appGraphRequest(ctx, "users/checkMemberGroups", "POST",
+		fmt.Sprint("/v1.0/users/", url.PathEscape(azureId), "/checkMemberGroups"), body)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return false, fmt.Errorf("ERROR: checkMemberGroups returned %d", response.StatusCode)
+	}
+
+	var result struct {
+		Value []string `json:"value"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return containsString(result.Value, groupId), nil
+}
+
+// requireAdmin lets the admin API key, or the public token of an admin group member, through
+// and records who it was for the logs
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := publicToken(r)
+		if token == "" {
+			unauthorized(w, "")
+			return
+		}
+
+		if isAdminAPIKey(token) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminKey{}, "api_key")))
+			return
+		}
+		if adminGroupId == "" {
+			failedLookup(r.Context())
+			unauthorized(w, "the admin API key is invalid")
+			return
+		}
+
+		user := FindUserByPubToken(r.Context(), token)
+		if (User{} == user) {
+			unauthorized(w, "the public token is invalid or expired")
+			return
+		}
+		member, err := adminMemberships.IsMember(r.Context(), user.AzureId)
+		if upstreamUnavailable(w, r, nil, err) {
+			return
+		}
+		if err != nil {
+			loggerFromContext(r.Context()).Error("Can not check admin group membership", "user_id", user.ID, "error", err)
+			http.Error(w, "Can not check admin group membership", http.StatusBadGateway)
+			return
+		}
+		if !member {
+			loggerFromContext(r.Context()).Warn("Admin API access denied", "user_id", user.ID)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminKey{}, fmt.Sprint("user:", user.ID))))
+	})
+}
+
+// isAdminAPIKey compares the token to ADMIN_API_KEY, hashing first keeps the comparison constant time
+// for keys of any length
+func isAdminAPIKey(token string) bool {
+	tokenSum, keySum := sha256.Sum256([]byte(token)), sha256.Sum256([]byte(adminAPIKey))
+	return adminAPIKey != "" && subtle.ConstantTimeCompare(tokenSum[:], keySum[:]) == 1
+}
+
+// adminFromContext is who requireAdmin let through, "api_key" or "user:<id>"
+func adminFromContext(ctx context.Context) string {
+	admin, _ := ctx.Value(adminKey{}).(string)
+	return admin
+}
+
+// adminUserParam loads the user of the :id route segment, answering 404 when there is none
+func adminUserParam(w http.ResponseWriter, r *http.Request) (User, bool) {
+	id, err := strconv.ParseUint(routeParam(r, "id"), 10, 32)
+	if err == nil {
+		if user := FindUserWithDeleted(r.Context(), uint(id)); user.ID != 0 {
+			return user, true
+		}
+	}
+	http.Error(w, "User not found", http.StatusNotFound)
+	return User{}, false
+}
+
+// queryInt reads a non-negative integer query parameter, the default when it is missing or invalid
+func queryInt(r *http.Request, name string, defaultValue int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// adminListUsersHandler lists users matching q and status, paged with limit and offset
+func adminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	limit := queryInt(r, "limit", 50)
+	if limit == 0 || limit > maxAdminPageSize {
+		limit = maxAdminPageSize
+	}
+	offset := queryInt(r, "offset", 0)
+
+	users, total := SearchUsers(r.Context(), r.URL.Query().Get("q"), r.URL.Query().Get("status"), limit, offset)
+	result := make([]userProfile, 0, len(users))
+	for _, user := range users {
+		result = append(result, newUserProfile(user))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"users": result, "total": total, "limit": limit, "offset": offset})
+}
+
+func adminGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserParam(w, r)
+	if !ok {
+		return
+	}
+	result := newUserProfile(user)
+	result.Sessions = user.Sessions(r.Context())
+	writeJSON(w, http.StatusOK, result)
+}
+
+func adminListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserParam(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": user.Sessions(r.Context())})
+}
+
+func adminRevokeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserParam(w, r)
+	if !ok {
+		return
+	}
+	user.RevokeSessions(r.Context())
+	auditUser(r.Context(), auditAdminRevoke, user, nil)
+	loggerFromContext(r.Context()).Info("Admin revoked sessions", "admin", adminFromContext(r.Context()), "user_id", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminPurgeTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserParam(w, r)
+	if !ok {
+		return
+	}
+	user.PurgeAzureTokens(r.Context())
+	auditUser(r.Context(), auditAdminPurge, user, nil)
+	loggerFromContext(r.Context()).Info("Admin purged Azure tokens", "admin", adminFromContext(r.Context()), "user_id", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserParam(w, r)
+	if !ok {
+		return
+	}
+	user.Erase(r.Context())
+	audit(r.Context(), AuditEvent{Event: auditAdminDelete, UserId: user.ID})
+	loggerFromContext(r.Context()).Info("Admin deleted user", "admin", adminFromContext(r.Context()), "user_id", user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminSetStatusHandler sets the status parameter, active, disabled or deleted, of the user
+func adminSetStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := adminUserParam(w, r)
+	if !ok {
+		return
+	}
+	status := r.FormValue("status")
+	switch status {
+	case userActive, userDisabled, userDeleted:
+	default:
+		http.Error(w, "status must be active, disabled or deleted", http.StatusBadRequest)
+		return
+	}
+
+	user.SetStatus(r.Context(), status)
+	audit(r.Context(), AuditEvent{Event: auditAdminSetStatus, Reason: status, UserId: user.ID, AzureId: user.AzureId})
+	loggerFromContext(r.Context()).Info("Admin set user status", "admin", adminFromContext(r.Context()), "user_id", user.ID, "status", status)
+	writeJSON(w, http.StatusOK, newUserProfile(user))
+}
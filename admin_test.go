@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// withAdminConfig runs the test with the admin API key and group given
+func withAdminConfig(t *testing.T, apiKey, groupId string) {
+	previousKey, previousGroup := adminAPIKey, adminGroupId
+	adminAPIKey, adminGroupId = apiKey, groupId
+	t.Cleanup(func() { adminAPIKey, adminGroupId = previousKey, previousGroup })
+}
+
+func TestIsAdminAPIKey(t *testing.T) {
+	withAdminConfig(t, "admin-key", "")
+	for token, want := range map[string]bool{
+		"admin-key":  true,
+		"admin-ke":   false,
+		"admin-key2": false,
+		"ADMIN-KEY":  false,
+		"":           false,
+	} {
+		if got := isAdminAPIKey(token); got != want {
+			t.Errorf("isAdminAPIKey(%q) = %v", token, got)
+		}
+	}
+
+	withAdminConfig(t, "", "")
+	if isAdminAPIKey("") {
+		t.Error("empty token matches an unset ADMIN_API_KEY")
+	}
+}
+
+// serveAdmin runs requireAdmin with the Authorization header given, returning the response and the admin let through
+func serveAdmin(authorization string) (*httptest.ResponseRecorder, string, int32) {
+	admin := ""
+	handler := requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin = adminFromContext(r.Context())
+	}))
+	request := httptest.NewRequest("GET", "/admin/users", nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	failures := new(int32)
+	request = request.WithContext(context.WithValue(request.Context(), lookupFailuresKey{}, failures))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder, admin, atomic.LoadInt32(failures)
+}
+
+func TestRequireAdminWithAPIKey(t *testing.T) {
+	withAdminConfig(t, "admin-key", "")
+
+	if response, admin, _ := serveAdmin("Bearer admin-key"); response.Code != http.StatusOK || admin != "api_key" {
+		t.Errorf("admin API key: got %d as %q", response.Code, admin)
+	}
+	if response, _, _ := serveAdmin(""); response.Code != http.StatusUnauthorized {
+		t.Errorf("no token: got %d", response.Code)
+	}
+	response, admin, failures := serveAdmin("Bearer wrong-key")
+	if response.Code != http.StatusUnauthorized || admin != "" || failures != 1 {
+		t.Errorf("wrong key: got %d as %q with %d failed lookups", response.Code, admin, failures)
+	}
+}
+
+func TestRequireAdminWithGroupMember(t *testing.T) {
+	openTestDB(t)
+	withAdminConfig(t, "", "admin-group")
+	ctx := context.Background()
+	admin := FindOrCreateUser(ctx, &OToken{Token: &oauth2.Token{}, ClientId: "app", PublicToken: "admin-token"}, &AzureUserInfo{ID: "admin"})
+	FindOrCreateUser(ctx, &OToken{Token: &oauth2.Token{}, ClientId: "app", PublicToken: "user-token"}, &AzureUserInfo{ID: "user"})
+
+	// seeded, so that Graph is not asked
+	previous := adminMemberships
+	adminMemberships = &membershipCache{members: map[string]cachedMembership{
+		"admin": {member: true, expiresAt: time.Now().Add(time.Minute)},
+		"user":  {member: false, expiresAt: time.Now().Add(time.Minute)},
+	}}
+	defer func() { adminMemberships = previous }()
+
+	if response, as, _ := serveAdmin("Bearer admin-token"); response.Code != http.StatusOK || as != "user:"+fmt.Sprint(admin.ID) {
+		t.Errorf("group member: got %d as %q", response.Code, as)
+	}
+	if response, _, _ := serveAdmin("Bearer user-token"); response.Code != http.StatusForbidden {
+		t.Errorf("other user: got %d", response.Code)
+	}
+	if response, _, failures := serveAdmin("Bearer unknown"); response.Code != http.StatusUnauthorized || failures != 1 {
+		t.Errorf("unknown token: got %d with %d failed lookups", response.Code, failures)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// App-only access to Graph with the client credentials grant, for back-office jobs without a signed-in user
+
+const (
+	graphResource = "https://graph.microsoft.com"
+
+	// tokens are renewed a little before they expire, so that requests in flight do not fail
+	appTokenExpiryMargin = 2 * time.Minute
+)
+
+var (
+	appTokens = &tokenCache{tokens: map[string]cachedToken{}}
+
+	// the only Graph queries trusted clients may run with the application permissions, by route
+	appGraphQueries = map[string]string{
+		"/app/users":         "/v1.0/users/%s?$select=id,displayName,userPrincipalName,mail,jobTitle,department,accountEnabled",
+		"/app/users/groups":  "/v1.0/users/%s/memberOf?$select=id,displayName",
+		"/app/users/manager": "/v1.0/users/%s/manager?$select=id,displayName,userPrincipalName,mail",
+	}
+)
+
+// aadTokenResponse is the part of a v1 token endpoint response the service uses
+type aadTokenResponse struct {
+	AccessToken  string      `json:"access_token"`
+	RefreshToken string      `json:"refresh_token"`
+	ExpiresIn    json.Number `json:"expires_in"`
+}
+
+type cachedToken struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+// tokenCache holds access tokens by key until shortly before they expire
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+// Get returns the cached token for the key, or acquires and caches a new one
+func (cache *tokenCache) Get(key string, acquire func() (aadTokenResponse, error)) (string, error) {
+	cache.mu.Lock()
+	token, ok := cache.tokens[key]
+	cache.mu.Unlock()
+	if ok && time.Now().Before(token.expiresAt) {
+		return token.accessToken, nil
+	}
+
+	response, err := acquire()
+	if err != nil {
+		return "", err
+	}
+	expiresIn, err := response.ExpiresIn.Int64()
+	if err != nil {
+		expiresIn = 0
+	}
+	token = cachedToken{
+		accessToken: response.AccessToken,
+		expiresAt:   time.Now().Add(time.Duration(expiresIn)*time.Second - appTokenExpiryMargin),
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	now := time.Now()
+	for k, t := range cache.tokens {
+		if now.After(t.expiresAt) {
+			delete(cache.tokens, k)
+		}
+	}
+	cache.tokens[key] = token
+	return token.accessToken, nil
+}
+
+// Delete drops the cached tokens whose key starts with prefix
+func (cache *tokenCache) Delete(prefix string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for k := range cache.tokens {
+		if strings.HasPrefix(k, prefix) {
+			delete(cache.tokens, k)
+		}
+	}
+}
+
+// appGraphRequest sends a request to Graph with the app-only token. Throttling and outages are returned
+// as UnavailableError, other statuses are left to the caller.
+func appGraphRequest(ctx context.Context, name, method, path string, body []byte) (*http.Response, error) {
+	accessToken, err := appTokens.Get(graphResource, func() (aadTokenResponse, error) {
+		return requestAppToken(ctx, graphResource)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, graphResource+path, reader)
+	handleError(err)
+	request.Header.Set("Authorization", fmt.Sprint("Bearer ", accessToken))
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := graphDo(name, request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if wait, ok := unavailable(response, nil); ok {
+		response.Body.Close()
+		return nil, &UnavailableError{Host: request.URL.Host, RetryAfter: wait}
+	}
+	if response.StatusCode == http.StatusUnauthorized {
+		// the cached token was revoked or the permissions changed, the next request acquires a new one
+		appTokens.Delete(graphResource)
+	}
+	return response, nil
+}
+
+// requestAppToken acquires a token for the resource with the client credentials grant
+func requestAppToken(ctx context.Context, resource string) (aadTokenResponse, error) {
+	ctx, span := tracer.Start(ctx, "oauth.client_credentials", spanKindInternal)
+	defer span.End()
+
+	params := url.Values{}
+	params.Set("grant_type", "client_credentials")
+	params.Set("resource", resource)
+	response, err := requestToken(ctx, params)
+	span.RecordError(err)
+	return response, err
+}
+
+// requestToken authenticates the service and posts a grant to the Azure AD token endpoint
+func requestToken(ctx context.Context, params url.Values) (aadTokenResponse, error) {
+	tokenUrl := fmt.Sprint(authority)
+	if err := addClientAuth(params, tokenUrl); err != nil {
+		return aadTokenResponse{}, err
+	}
+
+	request, err := http.NewRequest("POST", tokenUrl, bytes.NewReader([]byte(params.Encode())))
+	handleError(err)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := doWithTimeout(request.WithContext(ctx), tokenTimeout)
+	if err != nil {
+		return aadTokenResponse{}, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return aadTokenResponse{}, err
+	}
+	if response.StatusCode != 200 {
+		if wait, ok := unavailable(response, nil); ok {
+			return aadTokenResponse{}, &UnavailableError{Host: authority.Host, RetryAfter: wait}
+		}
+		return aadTokenResponse{}, fmt.Errorf("ERROR: token endpoint returned %d", response.StatusCode)
+	}
+
+	var tokenResponse aadTokenResponse
+	err = json.Unmarshal(body, &tokenResponse)
+	return tokenResponse, err
+}
+
+// authenticateTrustedClient only lets confidential clients registered with -trusted through
+func authenticateTrustedClient(w http.ResponseWriter, r *http.Request) (Client, bool) {
+	c, ok := authenticateClient(w, r)
+	if !ok {
+		return Client{}, false
+	}
+	if !c.IsConfidential() || !c.Trusted {
+		writeJSON(w, http.StatusForbidden, oidcError{"unauthorized_client", "the client is not trusted for app-only access"})
+		return Client{}, false
+	}
+	return c, true
+}
+
+// appGraphHandler runs one of appGraphQueries for the user given by the upn parameter
+func appGraphHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := authenticateTrustedClient(w, r)
+	if !ok {
+		return
+	}
+
+	query, ok := appGraphQueries[r.URL.Path]
+	upn := strings.TrimSpace(r.URL.Query().Get("upn"))
+	if !ok || upn == "" {
+		http.Error(w, "upn is required", http.StatusBadRequest)
+		return
+	}
+
+	log := loggerFromContext(r.Context()).With("client_id", c.ClientId)
+	path := fmt.Sprintf(query, url.PathEscape(upn))
+	response, err := appGraphRequest(r.Context(), strings.TrimPrefix(r.URL.Path, "/"), "GET", path, nil)
+	if upstreamUnavailable(w, r, nil, err) {
+		return
+	}
+	if err != nil {
+		log.Error("App-only Graph request failed", "error", err)
+		http.Error(w, "Graph request failed", http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	handleError(err)
+
+	log.Info("App-only Graph query", "query", r.URL.Path, "status", response.StatusCode)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.StatusCode)
+	w.Write(body)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Append-only audit trail of authentication events, stored in the audit_events table and optionally
+// written as JSON lines to AUDIT_LOG_FILE, a path or "stdout". The service never deletes events, erasing a user
+// only clears the personal data in theirs.
+
+const (
+	auditLoginStarted   = "login_started"
+	auditLoginCompleted = "login_completed"
+	auditLoginFailed    = "login_failed"
+	auditTokenExchange  = "token_exchange"
+	auditTokenRefresh   = "token_refresh"
+	auditLogout         = "logout"
+	auditAdminRevoke    = "admin_revoke_sessions"
+	auditAdminPurge     = "admin_purge_tokens"
+	auditAdminDelete    = "admin_delete_user"
+	auditUserErased     = "user_erased"
+	auditAdminSetStatus = "admin_set_status"
+	auditUserDisabled   = "user_disabled"
+
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+var auditLog = openAuditLog(getenvDefault("AUDIT_LOG_FILE", ""))
+
+type AuditEvent struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"time"`
+	Event     string    `gorm:"index" json:"event"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	UserId    uint      `gorm:"index" json:"user_id,omitempty"`
+	AzureId   string    `json:"azure_id,omitempty"`
+	ClientId  string    `json:"client_id,omitempty"`
+	Admin     string    `json:"admin,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestId string    `json:"request_id,omitempty"`
+}
+
+// auditWriter serializes the JSON lines of concurrent requests
+type auditWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func openAuditLog(name string) *auditWriter {
+	switch name {
+	case "":
+		return nil
+	case "stdout":
+		return &auditWriter{out: os.Stdout}
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	handleError(err)
+	return &auditWriter{out: file}
+}
+
+func (w *auditWriter) Write(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.out.Write(append(line, '\n'))
+	return err
+}
+
+type auditRequestKey struct{}
+
+type auditRequest struct {
+	ip        string
+	userAgent string
+}
+
+// auditMiddleware keeps the caller's IP and user agent for the events recorded while serving the request
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := auditRequest{ip: clientIP(r), userAgent: r.UserAgent()}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditRequestKey{}, info)))
+	})
+}
+
+// audit records the event with the request it happened in. Failing to store it is logged,
+// it does not fail the request.
+func audit(ctx context.Context, event AuditEvent) {
+	if info, ok := ctx.Value(auditRequestKey{}).(auditRequest); ok {
+		event.IP, event.UserAgent = info.ip, info.userAgent
+	}
+	if event.Admin == "" {
+		event.Admin = adminFromContext(ctx)
+	}
+	if event.Outcome == "" {
+		event.Outcome = auditSuccess
+	}
+	event.RequestId = requestID(ctx)
+	event.CreatedAt = time.Now().UTC()
+
+	if err := dbFrom(ctx).Create(&event).Error; err != nil {
+		loggerFromContext(ctx).Error("Can not store audit event", "event", event.Event, "error", err)
+	}
+	if auditLog != nil {
+		if err := auditLog.Write(event); err != nil {
+			loggerFromContext(ctx).Error("Can not write audit log", "event", event.Event, "error", err)
+		}
+	}
+}
+
+// auditUser records an event about the user
+func auditUser(ctx context.Context, event string, user User, err error) {
+	entry := AuditEvent{Event: event, UserId: user.ID, AzureId: user.AzureId, ClientId: user.Session.ClientId}
+	if err != nil {
+		entry.Outcome, entry.Reason = auditFailure, err.Error()
+	}
+	audit(ctx, entry)
+}
+
+// FindAuditEvents filters the audit trail by user and event, newest events first
+func FindAuditEvents(ctx context.Context, userId uint, event string, since, until time.Time, limit, offset int) (events []AuditEvent, total int) {
+	scope := dbFrom(ctx).Model(&AuditEvent{})
+	if userId != 0 {
+		scope = scope.Where("user_id = ?", userId)
+	}
+	if event != "" {
+		scope = scope.Where("event = ?", event)
+	}
+	if !since.IsZero() {
+		scope = scope.Where("created_at >= ?", since)
+	}
+	if !until.IsZero() {
+		scope = scope.Where("created_at < ?", until)
+	}
+	scope.Count(&total)
+	scope.Order("id DESC").Limit(limit).Offset(offset).Find(&events)
+	return
+}
+
+// adminAuditHandler lists audit events, filtered by user_id, event and the RFC 3339 times since and until
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := queryInt(r, "limit", 50)
+	if limit == 0 || limit > maxAdminPageSize {
+		limit = maxAdminPageSize
+	}
+	offset := queryInt(r, "offset", 0)
+
+	var times [2]time.Time
+	for i, name := range []string{"since", "until"} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			times[i] = t
+		}
+	}
+	userId, _ := strconv.ParseUint(query.Get("user_id"), 10, 32)
+
+	events, total := FindAuditEvents(r.Context(), uint(userId), query.Get("event"), times[0], times[1], limit, offset)
+	if events == nil {
+		events = []AuditEvent{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": events, "total": total, "limit": limit, "offset": offset})
+}
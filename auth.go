@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Authentication of the API endpoints by the public token
+
+type userKey struct{}
+
+// bearerToken reads an Authorization header value, "Bearer <token>" or the raw token older clients send.
+// Other schemes, such as Basic, yield no token.
+func bearerToken(header string) string {
+	fields := strings.Fields(header)
+	switch {
+	case len(fields) == 2 && strings.EqualFold(fields[0], "Bearer"):
+		return fields[1]
+	case len(fields) == 1 && !strings.EqualFold(fields[0], "Bearer"):
+		return fields[0]
+	}
+	return ""
+}
+
+// requireUser resolves the user of the public token in the Authorization header or the session cookie,
+// answering 401 without one. Behind rateLimitIP, so that failed lookups count towards the lockout.
+func requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := publicToken(r)
+		if token == "" {
+			unauthorized(w, "")
+			return
+		}
+		user := FindUserByPubToken(r.Context(), token)
+		if (User{} == user) {
+			unauthorized(w, "the public token is invalid or expired")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userKey{}, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// userFromContext returns the user requireUser authenticated
+func userFromContext(ctx context.Context) User {
+	user, _ := ctx.Value(userKey{}).(User)
+	return user
+}
+
+// unauthorized answers 401 with the challenge of RFC 6750, with the error only when a token was sent
+func unauthorized(w http.ResponseWriter, description string) {
+	challenge := `Bearer realm="azure_auth"`
+	if description != "" {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, description)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := map[string]string{
+		"Bearer abc":      "abc",
+		"bearer abc":      "abc",
+		"BEARER  abc ":    "abc",
+		"abc":             "abc",
+		"Bearer":          "",
+		"Bearer ":         "",
+		"":                "",
+		"Bearer abc def":  "",
+		"Basic dXNlcjpw":  "",
+		"Token abc":       "",
+		"Bearer\tabc":     "abc",
+		"  abc  ":         "abc",
+		"Bearer abc, def": "",
+	}
+	for header, want := range tests {
+		if got := bearerToken(header); got != want {
+			t.Errorf("bearerToken(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestRequireUserWithoutToken(t *testing.T) {
+	handler := requireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran without a token")
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/get_me", nil))
+
+	if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("WWW-Authenticate") != `Bearer realm="azure_auth"` {
+		t.Errorf("got %d with challenge %q", recorder.Code, recorder.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	expired := time.Now().Add(-time.Minute)
+	FindOrCreateUser(ctx, &OToken{Token: &oauth2.Token{}, ClientId: "app", PublicToken: "valid"}, &AzureUserInfo{ID: "azure-id"})
+	FindOrCreateUser(ctx, &OToken{Token: &oauth2.Token{}, ClientId: "old", PublicToken: "expired", PublicTokenExpiresAt: &expired}, &AzureUserInfo{ID: "azure-id"})
+
+	handler := requireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(userFromContext(r.Context()).AzureId))
+	}))
+	serve := func(request *http.Request) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	for _, header := range []string{"Bearer valid", "valid"} {
+		request := httptest.NewRequest("GET", "/get_me", nil)
+		request.Header.Set("Authorization", header)
+		if response := serve(request); response.Body.String() != "azure-id" {
+			t.Errorf("%q: got %d %q", header, response.Code, response.Body)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/get_me", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "valid"})
+	if response := serve(request); response.Body.String() != "azure-id" {
+		t.Errorf("session cookie: got %d %q", response.Code, response.Body)
+	}
+
+	for _, header := range []string{"Bearer expired", "Bearer unknown"} {
+		request := httptest.NewRequest("GET", "/get_me", nil)
+		request.Header.Set("Authorization", header)
+		response := serve(request)
+		if response.Code != http.StatusUnauthorized || !strings.Contains(response.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+			t.Errorf("%q: got %d with challenge %q", header, response.Code, response.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
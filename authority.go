@@ -12,3 +12,8 @@ type Authority struct {
 func (a Authority) String() string {
 	return fmt.Sprintf("https://%s/%s%s", a.Host, a.Tenant, "/oauth2/token")
 }
+
+// DiscoveryURL is the OpenID Connect metadata document of the tenant
+func (a Authority) DiscoveryURL() string {
+	return fmt.Sprintf("https://%s/%s%s", a.Host, a.Tenant, "/.well-known/openid-configuration")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// Client is an application registered to log users in through this service
+type Client struct {
+	gorm.Model
+	ClientId   string `gorm:"unique_index"`
+	Name       string
+	SecretHash string
+	// comma separated, same syntax as RETURN_URL_ALLOWLIST
+	RedirectUris string
+	// space separated Azure AD scopes the client may request on top of OuathScopes
+	AllowedScopes     string
+	TemporaryTokenTtl time.Duration
+	PublicTokenTtl    time.Duration
+	ResponseMode      string
+	// trusted service clients may use the app-only Graph endpoints
+	Trusted bool
+}
+
+var errInvalidClient = errors.New("invalid client")
+
+func FindClient(ctx context.Context, clientId string) (c Client) {
+	c = Client{}
+	if clientId == "" {
+		return
+	}
+	dbFrom(ctx).Find(&c, "client_id = ?", clientId)
+	return
+}
+
+func ListClients(ctx context.Context) (clients []Client) {
+	dbFrom(ctx).Order("id").Find(&clients)
+	return
+}
+
+// Create registers the client, generating its client_id, and returns the secret of confidential clients
+func (c *Client) Create(ctx context.Context, confidential bool) (secret string) {
+	c.ClientId = fmt.Sprint(uuid.New())
+	if confidential {
+		secret = c.setNewSecret()
+	}
+
+	dbFrom(ctx).Create(c)
+	return
+}
+
+// RotateSecret replaces the client secret, the previous one stops working immediately
+func (c *Client) RotateSecret(ctx context.Context) string {
+	secret := c.setNewSecret()
+	dbFrom(ctx).Save(c)
+	return secret
+}
+
+func (c *Client) Delete(ctx context.Context) {
+	dbFrom(ctx).Delete(c)
+}
+
+func (c *Client) setNewSecret() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	handleError(err)
+
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	c.SecretHash = hashClientSecret(secret)
+	return secret
+}
+
+// secrets are 256 random bits, so a plain SHA-256 is enough to keep them unusable if the table leaks
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c Client) IsConfidential() bool {
+	return c.SecretHash != ""
+}
+
+// Authenticate checks the secret of confidential clients; public clients have none to check
+func (c Client) Authenticate(secret string) error {
+	if !c.IsConfidential() {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashClientSecret(secret)), []byte(c.SecretHash)) != 1 {
+		return errInvalidClient
+	}
+	return nil
+}
+
+func (c Client) redirectRules() []returnURLRule {
+	return parseReturnURLAllowlist(c.RedirectUris)
+}
+
+// ValidateScopes returns the requested scopes when the client is allowed all of them
+func (c Client) ValidateScopes(requested string) ([]string, error) {
+	allowed := map[string]bool{}
+	for _, scope := range strings.Fields(c.AllowedScopes) {
+		allowed[scope] = true
+	}
+
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !allowed[scope] {
+			return nil, errors.New("scope " + scope + " is not allowed for this client")
+		}
+	}
+	return scopes, nil
+}
+
+// tokenExpiry converts a client TTL to the expiry stored with the token, zero meaning no expiry
+func tokenExpiry(ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	expiresAt := time.Now().Add(ttl)
+	return &expiresAt
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const clientsUsage = `Usage: azure_auth [-d] clients <command> [arguments]
+
+Commands:
+  create -name NAME [-redirect-uris URIS] [-scopes SCOPES] [-temporary-token-ttl TTL]
+         [-public-token-ttl TTL] [-response-mode MODE] [-public] [-trusted]
+  list
+  rotate CLIENT_ID
+  delete CLIENT_ID
+`
+
+// runClientsCommand manages registered client applications from the command line
+func runClientsCommand(args []string) {
+	ctx := context.Background()
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, clientsUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "create":
+		createClientCommand(ctx, args[1:])
+	case "list":
+		listClientsCommand(ctx)
+	case "rotate":
+		c := findClientArg(ctx, args[1:])
+		secret := c.RotateSecret(ctx)
+		fmt.Printf("client_id:     %s\nclient_secret: %s\n", c.ClientId, secret)
+	case "delete":
+		c := findClientArg(ctx, args[1:])
+		c.Delete(ctx)
+		fmt.Printf("Deleted client %s\n", c.ClientId)
+	default:
+		fmt.Fprint(os.Stderr, clientsUsage)
+		os.Exit(2)
+	}
+}
+
+func createClientCommand(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("clients create", flag.ExitOnError)
+	name := flags.String("name", "", "name of the application")
+	redirectUris := flags.String("redirect-uris", "", "comma separated return URLs, same syntax as RETURN_URL_ALLOWLIST")
+	scopes := flags.String("scopes", "", "space separated Azure AD scopes the client may request")
+	temporaryTokenTtl := flags.Duration("temporary-token-ttl", 5*time.Minute, "lifetime of temporary tokens, 0 for no expiry")
+	publicTokenTtl := flags.Duration("public-token-ttl", 0, "lifetime of public tokens, 0 for no expiry")
+	responseMode := flags.String("response-mode", "", "default temporary token delivery: query, fragment, form_post, web_message or cookie")
+	public := flags.Bool("public", false, "public client (SPA, mobile or desktop app) without a secret")
+	trusted := flags.Bool("trusted", false, "service client allowed to use the app-only endpoints")
+	flags.Parse(args)
+
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "-name is required")
+		os.Exit(2)
+	}
+	parseReturnURLAllowlist(*redirectUris)
+	if *public && *trusted {
+		fmt.Fprintln(os.Stderr, "-trusted clients must be confidential")
+		os.Exit(2)
+	}
+	if *responseMode != "" {
+		if _, err := resolveResponseMode(Client{}, *responseMode, BaseUrl); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	c := Client{
+		Name:              *name,
+		RedirectUris:      *redirectUris,
+		AllowedScopes:     *scopes,
+		TemporaryTokenTtl: *temporaryTokenTtl,
+		PublicTokenTtl:    *publicTokenTtl,
+		ResponseMode:      *responseMode,
+		Trusted:           *trusted,
+	}
+	secret := c.Create(ctx, !*public)
+
+	fmt.Printf("client_id:     %s\n", c.ClientId)
+	if secret != "" {
+		fmt.Printf("client_secret: %s\n", secret)
+		fmt.Println("The secret is not stored and can not be shown again.")
+	}
+}
+
+func listClientsCommand(ctx context.Context) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLIENT_ID\tNAME\tTYPE\tREDIRECT_URIS\tSCOPES\tRESPONSE_MODE\tCREATED")
+	for _, c := range ListClients(ctx) {
+		kind := "public"
+		if c.IsConfidential() {
+			kind = "confidential"
+		}
+		if c.Trusted {
+			kind += ",trusted"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.ClientId, c.Name, kind, c.RedirectUris,
+			strings.Join(strings.Fields(c.AllowedScopes), ","), c.ResponseMode, c.CreatedAt.Format(time.RFC3339))
+	}
+	tw.Flush()
+}
+
+func findClientArg(ctx context.Context, args []string) Client {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, clientsUsage)
+		os.Exit(2)
+	}
+
+	c := FindClient(ctx, args[0])
+	if (Client{} == c) {
+		fmt.Fprintf(os.Stderr, "Client %s not found\n", args[0])
+		os.Exit(1)
+	}
+	return c
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CORS for browser apps calling the API endpoints from another origin, such as a SPA reading /get_me
+
+var (
+	corsAllowCredentials = getenvDefault("CORS_ALLOW_CREDENTIALS", "") == "true"
+	corsAllowedOrigins   = parseCORSOrigins(getenvDefault("CORS_ALLOWED_ORIGINS", ""), corsAllowCredentials)
+	corsMaxAge           = getenvDuration("CORS_MAX_AGE", 10*time.Minute)
+
+	corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowedHeaders = "Authorization, Content-Type, X-Request-Id, Traceparent, X-CSRF-Token"
+	corsExposedHeaders = "X-Request-Id, Retry-After, WWW-Authenticate, X-CSRF-Token"
+)
+
+// parseCORSOrigins reads comma separated origins such as https://app.example.com, or * for any origin
+// which would let every site read the responses with the user's cookies when credentials are allowed
+func parseCORSOrigins(list string, credentials bool) map[string]bool {
+	origins := map[string]bool{}
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" && !strings.HasPrefix(origin, "https://") && !strings.HasPrefix(origin, "http://") {
+			panic("Invalid origin in CORS_ALLOWED_ORIGINS: " + origin)
+		}
+		if origin == "*" && credentials {
+			panic("CORS_ALLOWED_ORIGINS=* can not be combined with CORS_ALLOW_CREDENTIALS")
+		}
+		origins[origin] = true
+	}
+	return origins
+}
+
+func corsOriginAllowed(origin string) bool {
+	return corsAllowedOrigins["*"] || corsAllowedOrigins[strings.ToLower(origin)]
+}
+
+// cors answers preflight requests and adds the CORS headers for allowed origins
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(corsAllowedOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed := corsOriginAllowed(origin)
+		w.Header().Add("Vary", "Origin")
+		if allowed {
+			if corsAllowedOrigins["*"] {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if corsAllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", fmt.Sprint(int64(corsMaxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+	"golang.org/x/oauth2"
+)
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientCertificate authenticates this service to Azure AD with a signed JWT instead of CLIENT_SECRET when set
+var clientCertificate = loadClientCertificate(
+	getenvDefault("AZURE_CLIENT_CERTIFICATE_FILE", ""),
+	getenvDefault("AZURE_CLIENT_CERTIFICATE_KEY_FILE", ""),
+	getenvDefault("AZURE_CLIENT_CERTIFICATE_PASSWORD", ""),
+)
+
+type ClientCertificate struct {
+	Certificate *x509.Certificate
+	Key         *rsa.PrivateKey
+}
+
+// loadClientCertificate reads a PEM certificate and RSA key, both may be in the same file,
+// or a PFX (PKCS #12) file holding both, protected by the password.
+// Without a certificate CLIENT_SECRET is required.
+func loadClientCertificate(certFile, keyFile, password string) *ClientCertificate {
+	if certFile == "" {
+		if ClientSecretConst == "" {
+			panic("Missing required environment variable CLIENT_SECRET or AZURE_CLIENT_CERTIFICATE_FILE")
+		}
+		return nil
+	}
+	switch strings.ToLower(filepath.Ext(certFile)) {
+	case ".pfx", ".p12":
+		pfx, err := ioutil.ReadFile(certFile)
+		handleError(err)
+		certificate, err := parsePFX(pfx, password)
+		if err != nil {
+			panic(fmt.Errorf("ERROR: can not load client certificate %s: %s", certFile, err))
+		}
+		return certificate
+	}
+	if keyFile == "" {
+		keyFile = certFile
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	handleError(err)
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	handleError(err)
+
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		panic(fmt.Errorf("ERROR: can not load client certificate: %s", err))
+	}
+	key, err := parseRSAPrivateKey(keyPEM)
+	if err != nil {
+		panic(fmt.Errorf("ERROR: can not load client certificate key: %s", err))
+	}
+	return &ClientCertificate{Certificate: cert, Key: key}
+}
+
+// parsePFX reads the RSA key and its certificate from a PFX file, the chain of CA certificates
+// exported along with it is skipped
+func parsePFX(data []byte, password string) (*ClientCertificate, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *rsa.PrivateKey
+	var certificates []*x509.Certificate
+	for _, block := range blocks {
+		switch block.Type {
+		case "PRIVATE KEY":
+			// PKCS #1 for RSA keys, despite the block type
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, errors.New("private key is not an RSA key")
+			}
+		case "CERTIFICATE":
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	if key == nil {
+		return nil, errors.New("no private key found in PFX data")
+	}
+	for _, certificate := range certificates {
+		if public, ok := certificate.PublicKey.(*rsa.PublicKey); ok && public.N.Cmp(key.N) == 0 {
+			return &ClientCertificate{Certificate: certificate, Key: key}, nil
+		}
+	}
+	return nil, errors.New("no certificate for the private key found in PFX data")
+}
+
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+	return nil, errors.New("no certificate found in PEM data")
+}
+
+// Assertion builds the client assertion for a request to the given token endpoint,
+// identifying the certificate by its SHA-1 thumbprint as Azure AD expects
+func (c *ClientCertificate) Assertion(tokenUrl string) (string, error) {
+	thumbprint := sha1.Sum(c.Certificate.Raw)
+	now := time.Now()
+
+	return signJWT(c.Key, map[string]interface{}{
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	}, map[string]interface{}{
+		"aud": tokenUrl,
+		"iss": ClientIdConst,
+		"sub": ClientIdConst,
+		"jti": fmt.Sprint(uuid.New()),
+		"nbf": now.Unix(),
+		"iat": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+}
+
+// oauth2ClientSecret is the secret of xOauth2Config, none with a certificate since Azure AD rejects requests
+// carrying both a secret and an assertion
+func oauth2ClientSecret() string {
+	if clientCertificate != nil {
+		return ""
+	}
+	return ClientSecretConst
+}
+
+// exchangeOptions adds the client assertion to an authorization code exchange done with xOauth2Config
+func exchangeOptions(tokenUrl string) ([]oauth2.AuthCodeOption, error) {
+	if clientCertificate == nil {
+		return nil, nil
+	}
+
+	assertion, err := clientCertificate.Assertion(tokenUrl)
+	if err != nil {
+		return nil, err
+	}
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("client_assertion_type", clientAssertionType),
+		oauth2.SetAuthURLParam("client_assertion", assertion),
+	}, nil
+}
+
+// addClientAuth authenticates a token request to Azure AD with the certificate or, without one, the client secret
+func addClientAuth(params url.Values, tokenUrl string) error {
+	params.Set("client_id", ClientIdConst)
+	if clientCertificate == nil {
+		params.Set("client_secret", ClientSecretConst)
+		return nil
+	}
+
+	assertion, err := clientCertificate.Assertion(tokenUrl)
+	if err != nil {
+		return err
+	}
+	params.Set("client_assertion_type", clientAssertionType)
+	params.Set("client_assertion", assertion)
+	return nil
+}
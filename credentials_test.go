@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestCodeExchangeWithCertificateSendsNoSecret(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	defer func(previous *ClientCertificate) { clientCertificate = previous }(clientCertificate)
+	clientCertificate = &ClientCertificate{Certificate: certificate, Key: key}
+
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+
+	config := xOauth2Config
+	config.ClientSecret = oauth2ClientSecret()
+	config.Endpoint = oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams}
+	options, err := exchangeOptions(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Exchange(context.Background(), "code", options...); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := form["client_secret"]; ok {
+		t.Error("client_secret was sent with the client assertion")
+	}
+	if len(form["client_assertion"]) != 1 || form["client_assertion_type"][0] != clientAssertionType {
+		t.Errorf("no client assertion in %v", form)
+	}
+}
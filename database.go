@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const maxConnectBackoff = 30 * time.Second
+
+type DBConfig struct {
+	Dialect         string
+	ConnStr         string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnectRetries  int
+	ConnectBackoff  time.Duration
+}
+
+// LoadDBConfig reads database settings from the environment.
+// DATABASE_URL (as provided by Heroku) takes precedence over the DB_* variables.
+func LoadDBConfig() DBConfig {
+	config := DBConfig{
+		Dialect:         dialect,
+		ConnStr:         connStr,
+		MaxOpenConns:    getenvInt("DB_MAX_OPEN_CONNS", 10),
+		MaxIdleConns:    getenvInt("DB_MAX_IDLE_CONNS", 2),
+		ConnMaxLifetime: getenvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		ConnectRetries:  getenvInt("DB_CONNECT_RETRIES", 5),
+		ConnectBackoff:  getenvDuration("DB_CONNECT_BACKOFF", time.Second),
+	}
+	if *devEnv {
+		return config
+	}
+
+	config.Dialect = "postgres"
+	tls := map[string]string{
+		"sslrootcert": getenvDefault("DB_SSLROOTCERT", ""),
+		"sslcert":     getenvDefault("DB_SSLCERT", ""),
+		"sslkey":      getenvDefault("DB_SSLKEY", ""),
+	}
+
+	if databaseUrl := getenvDefault("DATABASE_URL", ""); databaseUrl != "" {
+		// Heroku Postgres only accepts TLS connections
+		tls["sslmode"] = getenvDefault("DB_SSLMODE", "require")
+		config.ConnStr = postgresUrl(databaseUrl, tls)
+		return config
+	}
+
+	tls["sslmode"] = getenvDefault("DB_SSLMODE", "disable")
+	config.ConnStr = postgresDSN([][2]string{
+		{"host", getenv("DB_HOST")},
+		{"port", getenv("DB_PORT")},
+		{"user", getenv("DB_USER")},
+		{"password", getenv("DB_PASSWORD")},
+		{"dbname", getenv("DB_NAME")},
+		{"sslmode", tls["sslmode"]},
+		{"sslrootcert", tls["sslrootcert"]},
+		{"sslcert", tls["sslcert"]},
+		{"sslkey", tls["sslkey"]},
+	})
+	return config
+}
+
+// postgresUrl adds the TLS options to a postgres:// URL, keeping any already present in it
+func postgresUrl(rawUrl string, options map[string]string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		panic(fmt.Errorf("ERROR: invalid DATABASE_URL: %s", err))
+	}
+
+	query := u.Query()
+	for k, v := range options {
+		if v != "" && query.Get(k) == "" {
+			query.Set(k, v)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// postgresDSN builds a key=value connection string, quoting values as described in the lib/pq docs
+func postgresDSN(options [][2]string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	parts := make([]string, 0, len(options))
+	for _, o := range options {
+		if o[1] == "" {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s='%s'", o[0], escaper.Replace(o[1])))
+	}
+	return strings.Join(parts, " ")
+}
+
+func InitDB() *gorm.DB {
+	config := LoadDBConfig()
+
+	db, err := openDB(config)
+	if err != nil {
+		panic(err)
+	}
+	if db == nil {
+		panic("db nil")
+	}
+
+	db.DB().SetMaxOpenConns(config.MaxOpenConns)
+	db.DB().SetMaxIdleConns(config.MaxIdleConns)
+	db.DB().SetConnMaxLifetime(config.ConnMaxLifetime)
+	registerTracingCallbacks(db, config.Dialect)
+
+	db.AutoMigrate(&User{}, &Client{}, &AuthorizationCode{}, &OidcRefreshToken{}, &DeviceAuthorization{}, &AuditEvent{}, &WebhookDelivery{}, &ClientSession{})
+	migrateClientSessions(db)
+	return db
+}
+
+// openDB retries the connection with exponential backoff,
+// so the service survives starting before the database is accepting connections
+func openDB(config DBConfig) (*gorm.DB, error) {
+	backoff := config.ConnectBackoff
+	for attempt := 0; ; attempt++ {
+		db, err := gorm.Open(config.Dialect, config.ConnStr)
+		if err == nil {
+			return db, nil
+		}
+		if attempt >= config.ConnectRetries {
+			return nil, fmt.Errorf("ERROR: can not connect to database after %d attempts: %s", attempt+1, err)
+		}
+
+		logger.Warn("Database is not available, retrying", "error", err, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// DBReady reports whether the database accepts queries
+func DBReady(ctx context.Context) error {
+	if db == nil {
+		return errors.New("database is not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return db.DB().PingContext(ctx)
+}
+
+const (
+	tracingContextKey = "azure_auth:context"
+	tracingSpanKey    = "azure_auth:span"
+)
+
+// dbFrom returns the database handle bound to the request context, so that queries join its trace
+func dbFrom(ctx context.Context) *gorm.DB {
+	return db.Set(tracingContextKey, ctx)
+}
+
+func registerTracingCallbacks(db *gorm.DB, system string) {
+	start := func(operation string) func(*gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			ctx := context.Background()
+			if v, ok := scope.Get(tracingContextKey); ok {
+				ctx = v.(context.Context)
+			}
+
+			_, span := tracer.Start(ctx, fmt.Sprint("gorm.", operation, " ", scope.TableName()), spanKindClient)
+			span.SetAttribute("db.system", system)
+			span.SetAttribute("db.operation", operation)
+			span.SetAttribute("db.sql.table", scope.TableName())
+			scope.Set(tracingSpanKey, span)
+		}
+	}
+	end := func(scope *gorm.Scope) {
+		v, ok := scope.Get(tracingSpanKey)
+		if !ok {
+			return
+		}
+		span := v.(*Span)
+		span.SetAttribute("db.statement", scope.SQL)
+		if scope.HasError() && !gorm.IsRecordNotFoundError(scope.DB().Error) {
+			span.RecordError(scope.DB().Error)
+		}
+		span.End()
+	}
+
+	callback := db.Callback()
+	callback.Create().Before("gorm:create").Register("tracing:before_create", start("create"))
+	callback.Create().After("gorm:create").Register("tracing:after_create", end)
+	callback.Query().Before("gorm:query").Register("tracing:before_query", start("query"))
+	callback.Query().After("gorm:query").Register("tracing:after_query", end)
+	callback.Update().Before("gorm:update").Register("tracing:before_update", start("update"))
+	callback.Update().After("gorm:update").Register("tracing:after_update", end)
+	callback.Delete().Before("gorm:delete").Register("tracing:before_delete", start("delete"))
+	callback.Delete().After("gorm:delete").Register("tracing:after_delete", end)
+	callback.RowQuery().Before("gorm:row_query").Register("tracing:before_row_query", start("row_query"))
+	callback.RowQuery().After("gorm:row_query").Register("tracing:after_row_query", end)
+}
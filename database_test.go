@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// openTestDB replaces db with an empty in-memory SQLite database for the test, tests needing one are
+// skipped when built without cgo
+func openTestDB(t *testing.T) {
+	testDB, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Skip("SQLite is not available: ", err)
+	}
+	// every connection would get its own in-memory database
+	testDB.DB().SetMaxOpenConns(1)
+	testDB.AutoMigrate(&User{}, &Client{}, &AuthorizationCode{}, &OidcRefreshToken{}, &DeviceAuthorization{}, &AuditEvent{}, &WebhookDelivery{}, &ClientSession{})
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+}
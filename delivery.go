@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// How the temporary token is handed to the return URL at the end of the login
+const (
+	responseModeQuery      = "query"
+	responseModeFragment   = "fragment"
+	responseModeFormPost   = "form_post"
+	responseModeWebMessage = "web_message"
+)
+
+var (
+	DefaultResponseMode = getenvDefault("TEMP_TOKEN_RESPONSE_MODE", responseModeQuery)
+
+	formPostTemplate = template.Must(template.New("form_post").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Signing in</title></head>
+<body>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="temporary_token" value="{{.TemporaryToken}}">
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+<script nonce="{{.Nonce}}">document.forms[0].submit();</script>
+</body>
+</html>
+`))
+
+	webMessageTemplate = template.Must(template.New("web_message").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Signing in</title></head>
+<body>
+<script nonce="{{.Nonce}}">
+(function () {
+	var target = window.opener || window.parent;
+	target.postMessage({type: "azure_auth", temporary_token: {{.TemporaryToken}}}, {{.Origin}});
+	window.close();
+})();
+</script>
+</body>
+</html>
+`))
+)
+
+// resolveResponseMode validates the requested mode against the return URL it will be used with,
+// defaulting to the mode configured for the client
+func resolveResponseMode(c Client, mode string, returnTo string) (string, error) {
+	if mode == "" {
+		mode = c.ResponseMode
+	}
+	if mode == "" {
+		mode = DefaultResponseMode
+	}
+
+	switch mode {
+	case responseModeQuery, responseModeFragment:
+		return mode, nil
+	case responseModeFormPost, responseModeWebMessage, responseModeCookie:
+		u, err := url.Parse(returnTo)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return "", errors.New("response mode " + mode + " requires an http(s) return URL")
+		}
+		return mode, nil
+	}
+	return "", errors.New("unsupported response mode " + mode)
+}
+
+// deliverTempToken sends the browser on to the return URL with the temporary token
+func deliverTempToken(w http.ResponseWriter, r *http.Request, state loginState, tempToken string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	switch state.ResponseMode {
+	case responseModeFragment:
+		u, err := url.Parse(state.ReturnTo)
+		handleError(err)
+		u.Fragment = ""
+		u.RawFragment = ""
+		http.Redirect(w, r, u.String()+"#"+url.Values{"temporary_token": {tempToken}}.Encode(), http.StatusFound)
+
+	case responseModeFormPost:
+		nonce := pageSecurityPolicy(w, origin(state.ReturnTo), "")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		formPostTemplate.Execute(w, struct {
+			Action         string
+			TemporaryToken string
+			Nonce          string
+		}{state.ReturnTo, tempToken, nonce})
+
+	case responseModeWebMessage:
+		// the page runs in a popup or in an iframe of the return URL
+		returnOrigin := origin(state.ReturnTo)
+		nonce := pageSecurityPolicy(w, "", returnOrigin)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		webMessageTemplate.Execute(w, struct {
+			Origin         string
+			TemporaryToken string
+			Nonce          string
+		}{returnOrigin, tempToken, nonce})
+
+	default:
+		http.Redirect(w, r, generateTempTokenUrl(state.ReturnTo, tempToken), http.StatusFound)
+	}
+}
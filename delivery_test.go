@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeliverTempTokenQueryIsNotCached(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/callback", nil)
+	deliverTempToken(recorder, request, loginState{ReturnTo: "https://app.example.com/callback?x=1"}, "token")
+
+	if recorder.Code != http.StatusFound {
+		t.Errorf("got status %d, want %d", recorder.Code, http.StatusFound)
+	}
+	if cache := recorder.Header().Get("Cache-Control"); cache != "no-store" {
+		t.Errorf("got Cache-Control %q, want no-store", cache)
+	}
+	if location := recorder.Header().Get("Location"); location != "https://app.example.com/callback?temporary_token=token&x=1" {
+		t.Errorf("got Location %q", location)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Device authorization grant (RFC 8628) for command line tools: the tool polls /device/token
+// while the user signs in through the /auth flow on another device and enters the user code
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTtl       = 10 * time.Minute
+	// expired authorizations answer expired_token for this long before they are deleted
+	deviceExpiredRetention = time.Hour
+	devicePollInterval     = 5 * time.Second
+
+	deviceStatusPending  = "pending"
+	deviceStatusApproved = "approved"
+	deviceStatusDenied   = "denied"
+	deviceStatusConsumed = "consumed"
+
+	// no vowels, so that user codes never spell words
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+	// the confirmation form repeats this cookie, so that another site can not submit it for the user
+	deviceCSRFCookie = "device_csrf"
+)
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Connect a device</title></head>
+<body>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .ClientName}}
+<form method="post" action="{{.Action}}">
+<p>Sign in to <strong>{{.ClientName}}</strong> with the code <strong>{{.UserCode}}</strong>?</p>
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit">Continue</button>
+</form>
+{{else if not .Done}}
+<form method="get" action="{{.Action}}">
+<label>Enter the code shown on your device <input name="user_code" autocomplete="off" autofocus></label>
+<button type="submit">Next</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type DeviceAuthorization struct {
+	gorm.Model
+	DeviceCodeHash string `gorm:"unique_index"`
+	UserCode       string `gorm:"unique_index"`
+	ClientId       string
+	Scope          string
+	Status         string
+	// temporary token of the user who approved the device, exchanged once the device polls
+	TemporaryToken string
+	Interval       time.Duration
+	LastPolledAt   *time.Time
+	ExpiresAt      time.Time
+}
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type devicePage struct {
+	Action     string
+	Message    string
+	ClientName string
+	UserCode   string
+	CSRFToken  string
+	Done       bool
+}
+
+func newUserCode() string {
+	b := make([]byte, 8)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		handleError(err)
+		b[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(b[:4]) + "-" + string(b[4:])
+}
+
+// normalizeUserCode accepts codes typed in lower case, without the dash or with spaces
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+func FindPendingDeviceAuthorization(ctx context.Context, userCode string) (device DeviceAuthorization) {
+	device = DeviceAuthorization{}
+	if userCode == "" {
+		return
+	}
+	dbFrom(ctx).Where("status = ? AND expires_at > ?", deviceStatusPending, time.Now()).
+		Find(&device, "user_code = ?", normalizeUserCode(userCode))
+	return
+}
+
+func FindDeviceAuthorization(ctx context.Context, deviceCode string) (device DeviceAuthorization) {
+	device = DeviceAuthorization{}
+	if deviceCode == "" {
+		return
+	}
+	dbFrom(ctx).Find(&device, "device_code_hash = ?", hashToken(deviceCode))
+	return
+}
+
+// purgeExpiredDeviceAuthorizations deletes the device authorizations expired for longer than deviceExpiredRetention
+func purgeExpiredDeviceAuthorizations(ctx context.Context) int64 {
+	result := dbFrom(ctx).Unscoped().Where("expires_at < ?", time.Now().Add(-deviceExpiredRetention)).Delete(&DeviceAuthorization{})
+	if result.Error != nil {
+		logger.Error("Can not delete expired device authorizations", "error", result.Error)
+	}
+	return result.RowsAffected
+}
+
+// deviceCodeHandler starts a device authorization for the client
+func deviceCodeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	c, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	scopes, err := c.ValidateScopes(r.PostFormValue("scope"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_scope", err.Error()})
+		return
+	}
+
+	deviceCode := fmt.Sprint(uuid.New(), uuid.New())
+	device := DeviceAuthorization{
+		DeviceCodeHash: hashToken(deviceCode),
+		UserCode:       newUserCode(),
+		ClientId:       c.ClientId,
+		Scope:          strings.Join(scopes, " "),
+		Status:         deviceStatusPending,
+		Interval:       devicePollInterval,
+		ExpiresAt:      time.Now().Add(deviceCodeTtl),
+	}
+	dbFrom(r.Context()).Create(&device)
+
+	verificationUri := fmt.Sprint(BaseUrl, "/device")
+	writeJSON(w, http.StatusOK, deviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                device.UserCode,
+		VerificationUri:         verificationUri,
+		VerificationUriComplete: fmt.Sprint(verificationUri, "?user_code=", device.UserCode),
+		ExpiresIn:               int64(deviceCodeTtl / time.Second),
+		Interval:                int64(devicePollInterval / time.Second),
+	})
+}
+
+// deviceHandler is the verification page: the user enters the code, confirms the client and signs in
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	page := devicePage{Action: fmt.Sprint(BaseUrl, "/device")}
+	userCode := r.FormValue("user_code")
+	if userCode == "" {
+		renderDevicePage(w, http.StatusOK, page)
+		return
+	}
+
+	device := FindPendingDeviceAuthorization(r.Context(), userCode)
+	c := FindClient(r.Context(), device.ClientId)
+	if device.ID == 0 || (Client{} == c) {
+		failedLookup(r.Context())
+		page.Message = "The code is invalid or has expired."
+		renderDevicePage(w, http.StatusBadRequest, page)
+		return
+	}
+
+	// the user confirms which application the code belongs to before signing in
+	if r.Method != "POST" {
+		page.ClientName = c.Name
+		page.UserCode = device.UserCode
+		page.CSRFToken = newCSRFToken()
+		http.SetCookie(w, &http.Cookie{
+			Name:     deviceCSRFCookie,
+			Value:    page.CSRFToken,
+			Path:     "/device",
+			MaxAge:   int(deviceCodeTtl / time.Second),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(BaseUrl, "https://"),
+			SameSite: http.SameSiteStrictMode,
+		})
+		renderDevicePage(w, http.StatusOK, page)
+		return
+	}
+
+	csrfToken := r.PostFormValue("csrf_token")
+	cookie, err := r.Cookie(deviceCSRFCookie)
+	if err != nil || csrfToken == "" || subtle.ConstantTimeCompare([]byte(csrfToken), []byte(cookie.Value)) != 1 {
+		loggerFromContext(r.Context()).Warn("Device confirmation without a valid CSRF token")
+		page.Message = "The confirmation has expired, enter the code again."
+		renderDevicePage(w, http.StatusForbidden, page)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: deviceCSRFCookie, Path: "/device", MaxAge: -1})
+
+	login := loginState{ClientId: c.ClientId, ReturnTo: BaseUrl, DeviceUserCode: device.UserCode}
+	startAADLogin(w, r, login, strings.Fields(device.Scope))
+}
+
+// completeDeviceLogin links the temporary token issued by aadAuthHandler to the device authorization
+func completeDeviceLogin(w http.ResponseWriter, r *http.Request, userCode string, temporaryToken string) {
+	result := dbFrom(r.Context()).Model(&DeviceAuthorization{}).
+		Where("user_code = ? AND status = ? AND expires_at > ?", userCode, deviceStatusPending, time.Now()).
+		Updates(map[string]interface{}{"status": deviceStatusApproved, "temporary_token": temporaryToken})
+
+	page := devicePage{Done: true, Message: "Your device is connected, you can close this window."}
+	if result.RowsAffected != 1 {
+		page.Message = "The code has expired, start again on your device."
+	}
+	renderDevicePage(w, http.StatusOK, page)
+}
+
+func denyDeviceLogin(ctx context.Context, userCode string) {
+	dbFrom(ctx).Model(&DeviceAuthorization{}).
+		Where("user_code = ? AND status = ?", userCode, deviceStatusPending).
+		Update("status", deviceStatusDenied)
+}
+
+// deviceTokenHandler is polled by the device until the user approved it, then hands out a public token
+func deviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	c, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if r.PostFormValue("grant_type") != deviceCodeGrantType {
+		writeJSON(w, http.StatusBadRequest, oidcError{"unsupported_grant_type", ""})
+		return
+	}
+
+	device := FindDeviceAuthorization(r.Context(), r.PostFormValue("device_code"))
+	if device.ID == 0 || device.ClientId != c.ClientId || device.Status == deviceStatusConsumed {
+		failedLookup(r.Context())
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", ""})
+		return
+	}
+	if time.Now().After(device.ExpiresAt) {
+		writeJSON(w, http.StatusBadRequest, oidcError{"expired_token", ""})
+		return
+	}
+
+	now := time.Now()
+	polledTooSoon := device.LastPolledAt != nil && now.Sub(*device.LastPolledAt) < device.Interval
+	updates := map[string]interface{}{"last_polled_at": now}
+	if polledTooSoon {
+		updates["interval"] = device.Interval + devicePollInterval
+	}
+	dbFrom(r.Context()).Model(&device).Updates(updates)
+
+	switch {
+	case device.Status == deviceStatusDenied:
+		writeJSON(w, http.StatusBadRequest, oidcError{"access_denied", ""})
+		return
+	case polledTooSoon:
+		writeJSON(w, http.StatusBadRequest, oidcError{"slow_down", ""})
+		return
+	case device.Status == deviceStatusPending:
+		writeJSON(w, http.StatusBadRequest, oidcError{"authorization_pending", ""})
+		return
+	}
+
+	// consume first, so that concurrent polls can not both receive a token
+	result := dbFrom(r.Context()).Model(&DeviceAuthorization{}).
+		Where("id = ? AND status = ?", device.ID, deviceStatusApproved).
+		Updates(map[string]interface{}{"status": deviceStatusConsumed, "temporary_token": ""})
+	if result.RowsAffected != 1 {
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", ""})
+		return
+	}
+
+	user := exchangeTempToken(r.Context(), c, device.TemporaryToken)
+	if (User{} == user) {
+		writeJSON(w, http.StatusBadRequest, oidcError{"expired_token", ""})
+		return
+	}
+
+	response := tokenResponse{AccessToken: user.Session.PublicToken, TokenType: "Bearer", Scope: device.Scope}
+	if user.Session.PublicTokenExpiresAt != nil {
+		response.ExpiresIn = int64(time.Until(*user.Session.PublicTokenExpiresAt) / time.Second)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func renderDevicePage(w http.ResponseWriter, status int, page devicePage) {
+	// confirming the code submits to /device, which redirects on to the Azure AD sign in
+	pageSecurityPolicy(w, fmt.Sprint("'self' ", origin(xOauth2Config.Endpoint.AuthURL)), "")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	deviceTemplate.Execute(w, page)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPurgeExpiredDeviceAuthorizations(t *testing.T) {
+	openTestDB(t)
+	now := time.Now()
+	for code, expiresAt := range map[string]time.Time{
+		"PENDING": now.Add(deviceCodeTtl),
+		"EXPIRED": now.Add(-time.Minute),
+		"OLD":     now.Add(-deviceExpiredRetention - time.Minute),
+	} {
+		db.Create(&DeviceAuthorization{DeviceCodeHash: code, UserCode: code, ExpiresAt: expiresAt})
+	}
+
+	if purged := purgeExpiredDeviceAuthorizations(context.Background()); purged != 1 {
+		t.Errorf("purged %d device authorizations, want 1", purged)
+	}
+	var left []DeviceAuthorization
+	db.Unscoped().Order("user_code").Find(&left)
+	if len(left) != 2 || left[0].UserCode != "EXPIRED" || left[1].UserCode != "PENDING" {
+		t.Errorf("kept %v", left)
+	}
+}
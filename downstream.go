@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Tokens for our own Azure-hosted APIs, acquired for the signed-in user with the refresh token
+// or, for services that already hold an Azure AD token for this app, with the on-behalf-of grant
+
+const oboGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+var (
+	DownstreamAPIs = parseDownstreamAPIs(getenvDefault("DOWNSTREAM_APIS", ""))
+
+	userTokens = &tokenCache{tokens: map[string]cachedToken{}}
+)
+
+// DownstreamAPI is an API configured in DOWNSTREAM_APIS, BaseUrl is only set when it may be proxied
+type DownstreamAPI struct {
+	Name     string
+	Resource string
+	BaseUrl  string
+}
+
+// parseDownstreamAPIs reads comma separated entries of `name=resource` with an optional proxy base URL after a space
+func parseDownstreamAPIs(list string) map[string]DownstreamAPI {
+	apis := map[string]DownstreamAPI{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			panic("Invalid entry in DOWNSTREAM_APIS: " + entry)
+		}
+		fields := strings.Fields(parts[1])
+		if parts[0] == "" || len(fields) == 0 || len(fields) > 2 {
+			panic("Invalid entry in DOWNSTREAM_APIS: " + entry)
+		}
+
+		api := DownstreamAPI{Name: strings.TrimSpace(parts[0]), Resource: fields[0]}
+		if len(fields) == 2 {
+			u, err := url.Parse(fields[1])
+			if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+				panic("Invalid proxy URL in DOWNSTREAM_APIS: " + entry)
+			}
+			api.BaseUrl = strings.TrimSuffix(fields[1], "/")
+		}
+		apis[api.Name] = api
+	}
+	return apis
+}
+
+// UserToken returns a token for the API on behalf of the user, redeeming the refresh token
+// which Azure AD accepts for every resource the app has been consented to
+func (api DownstreamAPI) UserToken(ctx context.Context, user *User) (string, error) {
+	return userTokens.Get(fmt.Sprint(user.ID, " ", api.Resource), func() (aadTokenResponse, error) {
+		ctx, span := tracer.Start(ctx, "oauth.refresh", spanKindInternal)
+		defer span.End()
+		span.SetAttribute("resource", api.Resource)
+
+		params := url.Values{}
+		params.Set("grant_type", "refresh_token")
+		params.Set("refresh_token", user.RefreshToken)
+		params.Set("resource", api.Resource)
+		response, err := requestToken(ctx, params)
+		auditUser(ctx, auditTokenRefresh, *user, err)
+		if err != nil {
+			tokenRefreshTotal.Inc("failure")
+			span.RecordError(err)
+			if _, outage := unavailable(nil, err); !outage {
+				refreshRejected(ctx, user)
+			}
+			return response, err
+		}
+		tokenRefreshTotal.Inc("success")
+		user.SaveRefreshToken(ctx, response.RefreshToken)
+		return response, nil
+	})
+}
+
+// OnBehalfOfToken exchanges an Azure AD access token issued to this app for a token for the API
+func (api DownstreamAPI) OnBehalfOfToken(ctx context.Context, assertion string) (string, error) {
+	return userTokens.Get(fmt.Sprint("obo ", hashToken(assertion), " ", api.Resource), func() (aadTokenResponse, error) {
+		ctx, span := tracer.Start(ctx, "oauth.on_behalf_of", spanKindInternal)
+		defer span.End()
+		span.SetAttribute("resource", api.Resource)
+
+		params := url.Values{}
+		params.Set("grant_type", oboGrantType)
+		params.Set("assertion", assertion)
+		params.Set("requested_token_use", "on_behalf_of")
+		params.Set("resource", api.Resource)
+		response, err := requestToken(ctx, params)
+		span.RecordError(err)
+		return response, err
+	})
+}
+
+// downstreamTokenHandler hands a trusted client a token for the API, for the user given by public_token,
+// or on behalf of the caller of the client given by assertion
+func downstreamTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	c, ok := authenticateTrustedClient(w, r)
+	if !ok {
+		return
+	}
+	api, ok := DownstreamAPIs[routeParam(r, "resource")]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, oidcError{"invalid_target", "unknown resource"})
+		return
+	}
+
+	log := loggerFromContext(r.Context()).With("client_id", c.ClientId, "resource", api.Name)
+	var accessToken string
+	var err error
+	if assertion := r.PostFormValue("assertion"); assertion != "" {
+		accessToken, err = api.OnBehalfOfToken(r.Context(), assertion)
+	} else {
+		user := FindUserByPubToken(r.Context(), r.PostFormValue("public_token"))
+		if (User{} == user) {
+			writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", "public_token or assertion is required"})
+			return
+		}
+		log = log.With("user_id", user.ID)
+		accessToken, err = api.UserToken(r.Context(), &user)
+	}
+	if upstreamUnavailable(w, r, nil, err) {
+		return
+	}
+	if err != nil {
+		log.Warn("Can not acquire downstream token", "error", err)
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", "can not acquire a token for the resource"})
+		return
+	}
+
+	log.Info("Issued downstream token")
+	writeJSON(w, http.StatusOK, tokenResponse{AccessToken: accessToken, TokenType: "Bearer", Scope: api.Resource})
+}
+
+// downstreamProxyHandler forwards /api/{name}/... to the API with a token for the user whose
+// public token is in the Authorization header or the session cookie
+func downstreamProxyHandler(w http.ResponseWriter, r *http.Request) {
+	api, ok := DownstreamAPIs[routeParam(r, "name")]
+	if !ok || api.BaseUrl == "" {
+		http.Error(w, "Unknown API", http.StatusNotFound)
+		return
+	}
+	target, err := url.Parse(api.BaseUrl)
+	handleError(err)
+	targetPath, ok := downstreamPath(target.Path, routeParam(r, "*"))
+	if !ok {
+		http.Error(w, "Invalid API path", http.StatusBadRequest)
+		return
+	}
+
+	user := userFromContext(r.Context())
+	log := loggerFromContext(r.Context()).With("user_id", user.ID, "resource", api.Name)
+	accessToken, err := api.UserToken(r.Context(), &user)
+	if upstreamUnavailable(w, r, nil, err) {
+		return
+	}
+	if err != nil {
+		log.Warn("Can not acquire downstream token, try to auth again", "error", err)
+		http.Error(w, "Can not acquire a token for the API", http.StatusUnauthorized)
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = client.Transport
+	director := proxy.Director
+	proxy.Director = func(request *http.Request) {
+		director(request)
+		request.Host = target.Host
+		request.URL.Path = targetPath
+		request.URL.RawPath = ""
+		request.Header.Del("Cookie")
+		request.Header.Set("Authorization", fmt.Sprint("Bearer ", accessToken))
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if upstreamUnavailable(w, r, nil, err) {
+			return
+		}
+		log.Error("Downstream API request failed", "error", err)
+		http.Error(w, "API request failed", http.StatusBadGateway)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), downstreamTimeout)
+	defer cancel()
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// downstreamPath joins the request path to the base path of the API, false when ".." segments
+// would leave the base path, which the user's token is not meant for
+func downstreamPath(base, rest string) (string, bool) {
+	base = path.Clean("/" + base)
+	joined := path.Clean(singleJoiningSlash(base, rest))
+	if joined != base && !strings.HasPrefix(joined, singleJoiningSlash(base, "")) {
+		return "", false
+	}
+	if strings.HasSuffix(rest, "/") && !strings.HasSuffix(joined, "/") {
+		joined += "/"
+	}
+	return joined, true
+}
+
+func singleJoiningSlash(a, b string) string {
+	return strings.TrimSuffix(a, "/") + "/" + strings.TrimPrefix(b, "/")
+}
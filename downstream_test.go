@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestDownstreamPath(t *testing.T) {
+	tests := []struct {
+		base, rest, want string
+		ok               bool
+	}{
+		{"/v1", "users/me", "/v1/users/me", true},
+		{"/v1/", "/users/", "/v1/users/", true},
+		{"", "users", "/users", true},
+		{"/v1", "", "/v1", true},
+		{"/v1", "users/../groups", "/v1/groups", true},
+		{"/v1", "..", "", false},
+		{"/v1", "../admin", "", false},
+		{"/v1", "users/../../admin", "", false},
+		{"/v1", "../v1x/secret", "", false},
+		{"", "../../etc", "/etc", true},
+	}
+	for _, test := range tests {
+		got, ok := downstreamPath(test.base, test.rest)
+		if got != test.want || ok != test.ok {
+			t.Errorf("downstreamPath(%q, %q) = %q, %v, want %q, %v", test.base, test.rest, got, ok, test.want, test.ok)
+		}
+	}
+}
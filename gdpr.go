@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Data export and erasure for users, and the retention job erasing users inactive for longer than
+// RETENTION_PERIOD. Audit events outlive the erasure without the personal data in them.
+
+const retentionBatchSize = 100
+
+var (
+	retentionPeriod   = getenvDuration("RETENTION_PERIOD", 0)
+	retentionInterval = getenvDuration("RETENTION_INTERVAL", time.Hour)
+)
+
+// userExport is everything stored about a user
+type userExport struct {
+	Profile       userProfile       `json:"profile"`
+	Sessions      []Session         `json:"sessions"`
+	AuditEvents   []AuditEvent      `json:"audit_events"`
+	WebhookEvents []json.RawMessage `json:"webhook_events"`
+}
+
+// Erase deletes the user with their sessions, tokens and webhook deliveries, and clears the personal data
+// from their audit events. Webhook receivers are told with user.deleted, carrying just the ids, and its
+// deliveries are deleted once they are delivered or given up.
+func (user *User) Erase(ctx context.Context) {
+	user.Delete(ctx)
+	dbFrom(ctx).Where("user_id = ?", user.ID).Delete(&WebhookDelivery{})
+	dbFrom(ctx).Model(&AuditEvent{}).Where("user_id = ?", user.ID).
+		Updates(map[string]interface{}{"azure_id": "", "ip": "", "user_agent": ""})
+	notifyWebhooks(ctx, webhookUserDeleted, User{Model: gorm.Model{ID: user.ID}, AzureId: user.AzureId})
+}
+
+// userExportHandler returns the data stored about the caller as JSON
+func userExportHandler(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+
+	export := userExport{
+		Profile:       newUserProfile(user),
+		Sessions:      user.Sessions(r.Context()),
+		AuditEvents:   []AuditEvent{},
+		WebhookEvents: []json.RawMessage{},
+	}
+	dbFrom(r.Context()).Where("user_id = ?", user.ID).Order("id").Find(&export.AuditEvents)
+
+	// the payloads sent about the user, once per event rather than per receiver
+	var deliveries []WebhookDelivery
+	dbFrom(r.Context()).Where("user_id = ?", user.ID).Order("id").Find(&deliveries)
+	seen := map[string]bool{}
+	for _, delivery := range deliveries {
+		if !seen[delivery.EventId] {
+			seen[delivery.EventId] = true
+			export.WebhookEvents = append(export.WebhookEvents, json.RawMessage(delivery.Payload))
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", `attachment; filename="azure_auth_export.json"`)
+	writeJSON(w, http.StatusOK, export)
+}
+
+// userEraseHandler erases the caller, the session cookies included
+func userEraseHandler(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+	user.Erase(r.Context())
+	// the event outlives the erasure, so it is kept without the caller's IP and user agent
+	audit(context.WithValue(r.Context(), auditRequestKey{}, auditRequest{}),
+		AuditEvent{Event: auditUserErased, Reason: "request", UserId: user.ID})
+	loggerFromContext(r.Context()).Info("User erased on request", "user_id", user.ID)
+
+	setSessionCookie(w, sessionCookieName, "", true, nil)
+	setSessionCookie(w, csrfCookieName, "", false, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eraseInactiveUsers erases the users who have not logged in since the cutoff. Users from before the last login
+// was recorded count from their last update. Every pass starts after the last user seen, so users that can
+// not be erased are not picked up again.
+func eraseInactiveUsers(ctx context.Context, cutoff time.Time) int {
+	erased := 0
+	var lastId uint
+	for ctx.Err() == nil {
+		var users []User
+		err := dbFrom(ctx).Unscoped().Where("id > ? AND COALESCE(last_login_at, updated_at) < ?", lastId, cutoff).
+			Order("id").Limit(retentionBatchSize).Find(&users).Error
+		if err != nil {
+			logger.Error("Can not find inactive users", "error", err)
+			break
+		}
+		for _, user := range users {
+			user.Erase(ctx)
+			audit(ctx, AuditEvent{Event: auditUserErased, Reason: "retention", UserId: user.ID})
+			lastId = user.ID
+		}
+		erased += len(users)
+		if len(users) < retentionBatchSize {
+			break
+		}
+	}
+	return erased
+}
+
+// startRetentionJob erases inactive users and deletes expired device authorizations every RETENTION_INTERVAL
+// until the returned stop function is called, no user is erased without RETENTION_PERIOD
+func startRetentionJob() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var done sync.WaitGroup
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for {
+			if retentionPeriod > 0 {
+				if erased := eraseInactiveUsers(ctx, time.Now().Add(-retentionPeriod)); erased > 0 {
+					logger.Info("Erased inactive users", "count", erased, "retention_period", retentionPeriod.String())
+				}
+			}
+			purgeExpiredDeviceAuthorizations(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		done.Wait()
+	}
+}
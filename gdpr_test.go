@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestEraseOnRequestKeepsNoPersonalData(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	user := FindOrCreateUser(ctx, &OToken{Token: &oauth2.Token{}, ClientId: "app", PublicToken: "token"}, &AzureUserInfo{ID: "azure-id"})
+	auditUser(ctx, auditLoginCompleted, user, nil)
+
+	handler := chain(http.HandlerFunc(userEraseHandler), auditMiddleware, requireUser)
+	request := httptest.NewRequest("DELETE", "/users/me", nil)
+	request.RemoteAddr = "203.0.113.7:1234"
+	request.Header.Set("Authorization", "Bearer token")
+	request.Header.Set("User-Agent", "test-agent")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("got status %d", recorder.Code)
+	}
+
+	var count int
+	db.Unscoped().Model(&User{}).Where("id = ?", user.ID).Count(&count)
+	if count != 0 {
+		t.Error("user was not deleted")
+	}
+	var events []AuditEvent
+	db.Where("user_id = ?", user.ID).Find(&events)
+	erased := false
+	for _, event := range events {
+		erased = erased || event.Event == auditUserErased
+		if event.AzureId != "" || event.IP != "" || event.UserAgent != "" {
+			t.Errorf("%s event keeps %q, %q, %q", event.Event, event.AzureId, event.IP, event.UserAgent)
+		}
+	}
+	if !erased {
+		t.Error("the erasure was not recorded")
+	}
+}
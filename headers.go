@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Browser security headers. Temporary tokens travel in URLs, so the Referer header is never sent.
+
+// apiContentSecurityPolicy covers the JSON and text responses, the HTML pages set their own with pageSecurityPolicy
+const apiContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", apiContentSecurityPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pageSecurityPolicy sets the CSP of an HTML page and returns the nonce its inline scripts must carry.
+// formAction and frameAncestor are CSP sources, or "" for none.
+func pageSecurityPolicy(w http.ResponseWriter, formAction string, frameAncestor string) string {
+	nonce := randomHex(16)
+	if formAction == "" {
+		formAction = "'none'"
+	}
+	if frameAncestor == "" {
+		frameAncestor = "'none'"
+	} else {
+		// X-Frame-Options has no way to allow one origin, CSP frame-ancestors replaces it
+		w.Header().Del("X-Frame-Options")
+	}
+
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf(
+		"default-src 'none'; script-src 'nonce-%s'; form-action %s; frame-ancestors %s; base-uri 'none'",
+		nonce, formAction, frameAncestor))
+	return nonce
+}
+
+// origin is the scheme and host of an absolute URL
+func origin(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
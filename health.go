@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+var checkAADReadiness = getenvDefault("READYZ_CHECK_AAD", "false") == "true"
+
+type readinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// healthzHandler reports that the process is up and serving requests
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// readyzHandler reports whether the service can handle logins: the database must answer a ping
+// and, when READYZ_CHECK_AAD is enabled, the Azure AD discovery document must be reachable
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	response := readinessResponse{Status: "ok", Checks: map[string]string{}}
+
+	checks := map[string]func(context.Context) error{"database": DBReady}
+	if checkAADReadiness {
+		checks["aad"] = aadReady
+	}
+
+	for name, check := range checks {
+		if err := check(r.Context()); err != nil {
+			response.Status = "unavailable"
+			response.Checks[name] = err.Error()
+			continue
+		}
+		response.Checks[name] = "ok"
+	}
+
+	status := http.StatusOK
+	if response.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func aadReady(ctx context.Context) error {
+	request, err := http.NewRequest("GET", authority.DiscoveryURL(), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := doWithTimeout(request.WithContext(ctx), timeout)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("discovery document returned %d", response.StatusCode)
+	}
+	return nil
+}
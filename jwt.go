@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// RS256 JSON Web Tokens, signed with the key published on /jwks
+
+var signingKey = loadSigningKey(getenvDefault("OIDC_SIGNING_KEY_FILE", ""))
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type SigningKey struct {
+	Private *rsa.PrivateKey
+	Kid     string
+}
+
+// loadSigningKey reads a PEM encoded RSA key (PKCS#1 or PKCS#8); without one a key is generated,
+// which invalidates every issued token on restart and is only suitable for development
+func loadSigningKey(path string) *SigningKey {
+	if path == "" {
+		logger.Warn("OIDC_SIGNING_KEY_FILE is not set, using an ephemeral signing key")
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		handleError(err)
+		return &SigningKey{Private: key, Kid: jwkThumbprint(&key.PublicKey)}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	handleError(err)
+	key, err := parseRSAPrivateKey(data)
+	if err != nil {
+		panic(fmt.Errorf("ERROR: can not load OIDC signing key: %s", err))
+	}
+	return &SigningKey{Private: key, Kid: jwkThumbprint(&key.PublicKey)}
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("private key is not an RSA key")
+			}
+			return rsaKey, nil
+		}
+	}
+	return nil, errors.New("no private key found in PEM data")
+}
+
+func publicJWK(key *rsa.PublicKey, kid string) jwk {
+	return jwk{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// jwkThumbprint computes the RFC 7638 key ID
+func jwkThumbprint(key *rsa.PublicKey) string {
+	k := publicJWK(key, "")
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// signJWT encodes the claims with the given extra header fields and signs them with RS256
+func signJWT(key *rsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) (string, error) {
+	h := map[string]interface{}{"alg": "RS256", "typ": "JWT"}
+	for k, v := range header {
+		h[k] = v
+	}
+
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Sign issues a token with this service's key
+func (k *SigningKey) Sign(typ string, claims map[string]interface{}) (string, error) {
+	return signJWT(k.Private, map[string]interface{}{"kid": k.Kid, "typ": typ}, claims)
+}
+
+// Verify checks the signature, type, issuer and expiry of a token issued by this service
+func (k *SigningKey) Verify(token string, typ string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		Typ string `json:"typ"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" || header.Kid != k.Kid || header.Typ != typ {
+		return nil, errors.New("unexpected token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&k.Private.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != BaseUrl {
+		return nil, errors.New("unexpected token issuer")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || time.Now().Unix() >= int64(exp) {
+		return nil, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
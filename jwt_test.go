@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testClaims() map[string]interface{} {
+	return map[string]interface{}{"iss": BaseUrl, "sub": "user", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+// unsignedJWT encodes header and claims without the signature
+func unsignedJWT(t *testing.T, header, claims map[string]interface{}) string {
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+func TestVerifyAcceptsSignedToken(t *testing.T) {
+	token, err := signingKey.Sign("JWT", testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := signingKey.Verify(token, "JWT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "user" {
+		t.Errorf("got sub %v, want user", claims["sub"])
+	}
+}
+
+func TestVerifyRejectsInvalidTokens(t *testing.T) {
+	sign := func(claims map[string]interface{}) string {
+		token, err := signingKey.Sign("JWT", claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	expired := testClaims()
+	expired["exp"] = time.Now().Add(-time.Second).Unix()
+	otherIssuer := testClaims()
+	otherIssuer["iss"] = "https://evil.example.com"
+
+	valid := strings.Split(sign(testClaims()), ".")
+	tamperedClaims := testClaims()
+	tamperedClaims["sub"] = "admin"
+	tampered := unsignedJWT(t, map[string]interface{}{"alg": "RS256", "kid": signingKey.Kid, "typ": "JWT"}, tamperedClaims)
+
+	otherKid, err := signJWT(signingKey.Private, map[string]interface{}{"kid": "other", "typ": "JWT"}, testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hsInput := unsignedJWT(t, map[string]interface{}{"alg": "HS256", "kid": signingKey.Kid, "typ": "JWT"}, testClaims())
+	mac := hmac.New(sha256.New, signingKey.Private.PublicKey.N.Bytes())
+	mac.Write([]byte(hsInput))
+
+	tests := map[string]string{
+		"expired":        sign(expired),
+		"other issuer":   sign(otherIssuer),
+		"tampered":       tampered + "." + valid[2],
+		"other kid":      otherKid,
+		"alg none":       unsignedJWT(t, map[string]interface{}{"alg": "none", "kid": signingKey.Kid, "typ": "JWT"}, testClaims()) + ".",
+		"HS256":          hsInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+		"malformed":      valid[0] + "." + valid[1],
+		"empty":          "",
+		"bad signature":  valid[0] + "." + valid[1] + ".AAAA",
+		"access as id":   sign(testClaims()),
+		"missing expiry": sign(map[string]interface{}{"iss": BaseUrl}),
+	}
+	for name, token := range tests {
+		typ := "JWT"
+		if name == "access as id" {
+			typ = accessTokenType
+		}
+		if _, err := signingKey.Verify(token, typ); err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	// RFC 7636 appendix B
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if !verifyCodeChallenge(challenge, verifier) {
+		t.Error("matching verifier was rejected")
+	}
+	if verifyCodeChallenge(challenge, verifier+"x") || verifyCodeChallenge(challenge, "") {
+		t.Error("wrong verifier was accepted")
+	}
+	if verifyCodeChallenge(verifier, verifier) {
+		t.Error("plain verifier was accepted")
+	}
+	if !verifyCodeChallenge("", "") || verifyCodeChallenge("", verifier) {
+		t.Error("code without challenge is not checked")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	levelNames = map[logLevel]string{levelDebug: "debug", levelInfo: "info", levelWarn: "warn", levelError: "error"}
+
+	logger = NewLogger(os.Stdout, parseLogLevel(getenvDefault("LOG_LEVEL", "info")))
+
+	// field names whose values are never written to the log
+	sensitiveKeys = []string{"token", "secret", "password", "authorization", "assertion", "cookie"}
+	// matched exactly, so that e.g. "status_code" is still logged
+	sensitiveExactKeys = []string{"code", "state"}
+
+	// credentials embedded in free-form values such as URLs, error messages or headers
+	sensitiveValues = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)((?:access_token|refresh_token|temporary_token|id_token|client_secret|client_assertion|code|state|password)=)[^&\s"]+`),
+		regexp.MustCompile(`(?i)((?:bearer|basic)\s+)[a-z0-9\-._~+/]+=*`),
+		regexp.MustCompile(`(?i)("(?:access_token|refresh_token|id_token|client_secret|password)"\s*:\s*")[^"]*`),
+	}
+)
+
+// Logger writes one JSON object per line, with secrets redacted from every field
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  logLevel
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, level logLevel) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level}
+}
+
+func parseLogLevel(name string) logLevel {
+	for level, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return level
+		}
+	}
+	return levelInfo
+}
+
+// With returns a logger that adds the given key/value pairs to every entry
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{mu: l.mu, out: l.out, level: l.level, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(levelDebug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(levelInfo, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(levelWarn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(levelError, msg, keyvals) }
+
+func (l *Logger) log(level logLevel, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": levelNames[level],
+		"msg":   redactString(msg),
+	}
+	all := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		var value interface{} = "(MISSING)"
+		if i+1 < len(all) {
+			value = all[i+1]
+		}
+		entry[key] = redactField(key, value)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","msg":"can not encode log entry: %s"}`, err))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+func redactField(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, k := range sensitiveKeys {
+		if strings.Contains(lower, k) {
+			return redacted
+		}
+	}
+	for _, k := range sensitiveExactKeys {
+		if lower == k {
+			return redacted
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return redactString(v.Error())
+	case string:
+		return redactString(v)
+	case fmt.Stringer:
+		return redactString(v.String())
+	case bool, int, int64, uint, uint64, float64:
+		return v
+	default:
+		return redactString(fmt.Sprint(v))
+	}
+}
+
+func redactString(s string) string {
+	for _, re := range sensitiveValues {
+		s = re.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the ID assigned to the inbound request by requestIDMiddleware, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// loggerFromContext returns the logger tagged with the request ID carried by ctx
+func loggerFromContext(ctx context.Context) *Logger {
+	if id := requestID(ctx); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
@@ -2,17 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/go-martini/martini"
-	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
 	"github.com/joho/godotenv"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -21,15 +21,10 @@ var (
 	db     *gorm.DB
 	devEnv = flag.Bool("d", false, "setup dev env var")
 
-	timeout = time.Duration(5 * time.Second)
-	client  = http.Client{
-		Timeout: timeout,
-	}
-
 	OuathScopes       = []string{"offline_access", "openid"}
 	ClientIdConst     = getenv("CLIENT_ID")
 	TenantConst       = getenv("TENANT")
-	ClientSecretConst = getenv("CLIENT_SECRET")
+	ClientSecretConst = getenvDefault("CLIENT_SECRET", "")
 	BaseUrl           = getenv("BASE_URL")
 	RedirectPath      = getenv("REDIRECT_PATH")
 	dialect           = "sqlite3"
@@ -37,11 +32,15 @@ var (
 	authority         = Authority{"login.microsoftonline.com", os.Getenv("TENANT")}
 )
 
-func getenv(name string) string {
+func loadDotEnv() {
 	_, err := os.Stat(".env")
 	if err == nil {
 		godotenv.Load()
 	}
+}
+
+func getenv(name string) string {
+	loadDotEnv()
 	v := os.Getenv(name)
 	if v == "" {
 		panic("Missing required environment variable " + name)
@@ -49,24 +48,72 @@ func getenv(name string) string {
 	return v
 }
 
-func getMeHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Authorization")
+// getenvDefault returns the value of an optional environment variable, or def when it is unset
+func getenvDefault(name, def string) string {
+	loadDotEnv()
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func getenvInt(name string, def int) int {
+	v := getenvDefault(name, "")
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		panic("Invalid integer in environment variable " + name)
+	}
+	return i
+}
+
+// getenvDuration parses values such as "30s" or "5m"
+func getenvDuration(name string, def time.Duration) time.Duration {
+	v := getenvDefault(name, "")
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		panic("Invalid duration in environment variable " + name)
+	}
+	return d
+}
 
-	user := FindUserByPubToken(token)
-	if (user == User{}) {
-		http.Error(w, "Record not found", http.StatusNotFound)
+func getMeHandler(w http.ResponseWriter, r *http.Request) {
+	log := loggerFromContext(r.Context())
+	user := userFromContext(r.Context())
+	if _, fromCookie := publicToken(r); fromCookie {
+		exposeCSRFToken(w, r)
+	}
+	meResponse, err := getMeRequest(r.Context(), user.AccessToken)
+	if upstreamUnavailable(w, r, meResponse, err) {
 		return
 	}
-	meResponse := getMeRequest(user.AccessToken)
+	handleError(err)
 	defer meResponse.Body.Close()
 
 	if meResponse.StatusCode != 200 {
-		retryWithRefresh(&user)
-		meResponse = getMeRequest(user.AccessToken)
+		if err := retryWithRefresh(r.Context(), &user); err != nil {
+			if upstreamUnavailable(w, r, nil, err) {
+				return
+			}
+			log.Warn("Can not refresh token, try to auth again", "user_id", user.ID, "error", err)
+		}
+		meResponse, err = getMeRequest(r.Context(), user.AccessToken)
+		if upstreamUnavailable(w, r, meResponse, err) {
+			return
+		}
+		handleError(err)
+		defer meResponse.Body.Close()
 
 		if meResponse.StatusCode != 200 {
 			authUrl := fmt.Sprint(BaseUrl, "/auth")
 			http.Redirect(w, r, authUrl, http.StatusNotFound)
+			return
 		}
 	}
 
@@ -79,74 +126,101 @@ func getMeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(meBytes)
 }
 
-func retryWithRefresh(user *User) {
-	fmt.Println("Trying to refresh token")
+func retryWithRefresh(ctx context.Context, user *User) (err error) {
+	ctx, span := tracer.Start(ctx, "oauth.refresh", spanKindInternal)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+		auditUser(ctx, auditTokenRefresh, *user, err)
+		if _, outage := unavailable(nil, err); err != nil && !outage {
+			refreshRejected(ctx, user)
+		}
+	}()
+
+	loggerFromContext(ctx).Info("Trying to refresh token", "user_id", user.ID)
 	params := url.Values{}
 
 	params.Add("grant_type", "refresh_token")
 	params.Add("refresh_token", user.RefreshToken)
-	params.Add("client_id", ClientIdConst)
-	params.Add("client_secret", ClientSecretConst)
-	params.Add("resource", "https://graph.microsoft.com")
+	params.Add("resource", graphResource)
+	tokenUrl := fmt.Sprint(authority)
+	if err = addClientAuth(params, tokenUrl); err != nil {
+		tokenRefreshTotal.Inc("failure")
+		return err
+	}
 
 	urlBytes := []byte(strings.TrimSpace(params.Encode()))
 
-	request, err := http.NewRequest("POST", fmt.Sprint(authority), bytes.NewReader(urlBytes))
+	request, err := http.NewRequest("POST", tokenUrl, bytes.NewReader(urlBytes))
 	if err != nil {
 		panic(fmt.Errorf("ERROR: %s", err))
 	}
 
 	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	request.Header.Set("client-request-id", fmt.Sprint(uuid.Must(uuid.NewRandom())))
-	request.Header.Set("client-return-client-request-id", "true")
-
-	response, err := client.Do(request)
-	if response.StatusCode != 200 {
-		fmt.Errorf("ERROR: %s", "Can not refresh token, try to auth again")
 
+	response, err := doWithTimeout(request.WithContext(ctx), tokenTimeout)
+	if err != nil {
+		tokenRefreshTotal.Inc("failure")
+		return err
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != 200 {
+		tokenRefreshTotal.Inc("failure")
+		if wait, ok := unavailable(response, nil); ok {
+			return &UnavailableError{Host: authority.Host, RetryAfter: wait}
+		}
+		return fmt.Errorf("ERROR: token endpoint returned %d", response.StatusCode)
+	}
+
 	var refreshTokenResponse refreshTokenResponse
 	meBytes, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		fmt.Errorf("ERROR: %s", err)
-
+		tokenRefreshTotal.Inc("failure")
+		return fmt.Errorf("ERROR: %s", err)
 	}
 
 	err = json.Unmarshal(meBytes, &refreshTokenResponse)
 	if err != nil {
-		fmt.Errorf("ERROR: %s", err)
-
+		tokenRefreshTotal.Inc("failure")
+		return fmt.Errorf("ERROR: %s", err)
 	}
 
-	RefreshToken(user, refreshTokenResponse)
-
+	if !RefreshToken(ctx, user, refreshTokenResponse) {
+		tokenRefreshTotal.Inc("failure")
+		return fmt.Errorf("ERROR: user %d is no longer active", user.ID)
+	}
+	tokenRefreshTotal.Inc("success")
+	return nil
 }
 
 func getPhotoHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Authorization")
-
-	user := FindUserByPubToken(token)
-	if (user == User{}) {
-		http.Error(w, "Record not found", http.StatusNotFound)
-		return
-	}
+	log := loggerFromContext(r.Context())
+	user := userFromContext(r.Context())
 
 	tokenStr := fmt.Sprint("Bearer ", user.AccessToken)
 
 	picRequest, err := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/me/photo/$value", nil)
+	handleError(err)
 	picRequest.Header.Set("Authorization", tokenStr)
-	picResponse, err := client.Do(picRequest)
-	if picResponse.StatusCode != 200 {
-		fmt.Println("Something went wrong, accessing user picture")
+	picResponse, err := graphDo("me/photo", picRequest.WithContext(r.Context()))
+	if upstreamUnavailable(w, r, picResponse, err) {
 		return
 	}
 	if err != nil {
-		fmt.Errorf("ERROR: %s", err)
+		log.Error("Can not access user picture", "user_id", user.ID, "error", err)
+		return
+	}
+	defer picResponse.Body.Close()
+
+	if picResponse.StatusCode != 200 {
+		log.Warn("Something went wrong, accessing user picture", "user_id", user.ID, "status", picResponse.StatusCode)
 		return
 	}
-	pictureBinary, _ := ioutil.ReadAll(picResponse.Body)
+	pictureBinary, err := ioutil.ReadAll(picResponse.Body)
+	if err != nil {
+		log.Error("Can not read user picture", "user_id", user.ID, "error", err)
+	}
 	if pictureBinary == nil {
 		w.Write([]byte{})
 	}
@@ -160,13 +234,64 @@ func main() {
 	db = InitDB()
 	defer db.Close()
 
-	m := martini.Classic()
+	if flag.Arg(0) == "clients" {
+		runClientsCommand(flag.Args()[1:])
+		return
+	}
+
+	// deferred first so that it runs after the workers have stopped and can not end spans anymore
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		tracer.Shutdown(ctx)
+	}()
+
+	stopWebhooks := startWebhookWorker()
+	defer stopWebhooks()
+	stopRetention := startRetentionJob()
+	defer stopRetention()
+
+	r := NewRouter()
+	r.Get("/get_me", getMeHandler, rateLimitIP, requireUser)
+	r.Get("/get_user_photo", getPhotoHandler, rateLimitIP, requireUser)
+	r.Post("/auth_with_temporary_token", authWithTempTokenHandler, rateLimit)
+	r.Get("/auth", oauthHandler)
+	r.Get("/auth_url", oauthUrlHandler)
+	r.Get(RedirectPath, aadAuthHandler)
+	r.Get("/.well-known/openid-configuration", openidConfigurationHandler)
+	r.Get("/authorize", authorizeHandler)
+	r.Post("/token", tokenHandler, rateLimit)
+	r.Get("/userinfo", userinfoHandler, rateLimitIP)
+	r.Post("/userinfo", userinfoHandler, rateLimitIP)
+	r.Get("/jwks", jwksHandler)
+	r.Post("/device/code", deviceCodeHandler, rateLimit)
+	r.Get("/device", deviceHandler, rateLimitIP)
+	r.Post("/device", deviceHandler, rateLimitIP)
+	r.Post("/device/token", deviceTokenHandler, rateLimitIP)
+	r.Get("/app/users", appGraphHandler, requireClientCertificate, rateLimitIP)
+	r.Get("/app/users/groups", appGraphHandler, requireClientCertificate, rateLimitIP)
+	r.Get("/app/users/manager", appGraphHandler, requireClientCertificate, rateLimitIP)
+	r.Post("/token/:resource", downstreamTokenHandler, requireClientCertificate, rateLimitIP)
+	r.Any("/api/:name/*", downstreamProxyHandler, rateLimitIP, csrfProtect, requireUser)
+	r.Post("/logout", logoutHandler, rateLimitIP, csrfProtect)
+	r.Get("/users/me/export", userExportHandler, rateLimitIP, requireUser)
+	r.Delete("/users/me", userEraseHandler, rateLimitIP, csrfProtect, requireUser)
+	if adminAPIKey != "" || adminGroupId != "" {
+		r.Get("/admin/users", adminListUsersHandler, rateLimitIP, requireAdmin)
+		r.Get("/admin/audit", adminAuditHandler, rateLimitIP, requireAdmin)
+		r.Get("/admin/webhooks/deliveries", adminWebhookDeliveriesHandler, rateLimitIP, requireAdmin)
+		r.Post("/admin/webhooks/test", adminWebhookTestHandler, rateLimitIP, csrfProtect, requireAdmin)
+		r.Get("/admin/users/:id", adminGetUserHandler, rateLimitIP, requireAdmin)
+		r.Delete("/admin/users/:id", adminDeleteUserHandler, rateLimitIP, csrfProtect, requireAdmin)
+		r.Post("/admin/users/:id/status", adminSetStatusHandler, rateLimitIP, csrfProtect, requireAdmin)
+		r.Get("/admin/users/:id/sessions", adminListSessionsHandler, rateLimitIP, requireAdmin)
+		r.Delete("/admin/users/:id/sessions", adminRevokeSessionsHandler, rateLimitIP, csrfProtect, requireAdmin)
+		r.Delete("/admin/users/:id/tokens", adminPurgeTokensHandler, rateLimitIP, csrfProtect, requireAdmin)
+	}
+	r.Get("/healthz", healthzHandler)
+	r.Get("/readyz", readyzHandler)
+	r.Get("/metrics", metricsHandler)
 
-	m.Get("/get_me", getMeHandler)
-	m.Get("/get_user_photo", getPhotoHandler)
-	m.Post("/auth_with_temporary_token", authWithTempTokenHandler)
-	m.Get("/auth", oauthHandler)
-	m.Get("/auth_url", oauthUrlHandler)
-	m.Get(RedirectPath, aadAuthHandler)
-	m.Run()
+	// recovery innermost, so that the request logger and the trace see the 500 of a panic
+	serve(chain(r, requestIDMiddleware, tracingMiddleware, auditMiddleware, requestLogger, recovery, strictTransportSecurity, securityHeaders, cors))
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal Prometheus text exposition (format 0.0.4), enough for the handful of metrics this service exposes
+
+var (
+	defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	loginsTotal = newCounterVec("azure_auth_logins_total",
+		"Logins started and completed through Azure AD.", "stage")
+	callbackFailuresTotal = newCounterVec("azure_auth_callback_failures_total",
+		"Failed Azure AD redirects to the callback handler.", "reason")
+	tokenRefreshTotal = newCounterVec("azure_auth_token_refresh_total",
+		"Attempts to refresh Azure AD access tokens.", "result")
+	graphRequestDuration = newHistogramVec("azure_auth_graph_request_duration_seconds",
+		"Latency of Microsoft Graph requests.", defaultBuckets, "endpoint", "status")
+	httpRetriesTotal = newCounterVec("azure_auth_http_retries_total",
+		"Outbound requests retried after throttling or a transient failure.", "host")
+	rateLimitedTotal = newCounterVec("azure_auth_rate_limited_total",
+		"Requests rejected with 429 by the rate limiter.", "reason")
+	activeSessions = newGaugeFunc("azure_auth_active_sessions",
+		"Client sessions holding a public token that has not expired.", countActiveSessions)
+
+	metrics = []collector{loginsTotal, callbackFailuresTotal, tokenRefreshTotal, graphRequestDuration, httpRetriesTotal, rateLimitedTotal, activeSessions}
+)
+
+type collector interface {
+	write(buf *bytes.Buffer)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	key := labelKey(labelValues)
+
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(buf, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := labelKey(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upper := range h.buckets {
+			le := fmt.Sprintf(`le="%s"`, formatFloat(upper))
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, le), s.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, `le="+Inf"`), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+// gaugeFunc is evaluated on every scrape
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	return &gaugeFunc{name: name, help: help, value: value}
+}
+
+func (g *gaugeFunc) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(buf, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, key string, extra string) string {
+	pairs := make([]string, 0, len(names)+1)
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], strconv.Quote(v)))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func countActiveSessions() float64 {
+	if db == nil {
+		return 0
+	}
+	var count int
+	db.Model(&ClientSession{}).Where("public_token <> ''").
+		Where("public_token_expires_at IS NULL OR public_token_expires_at > ?", time.Now()).Count(&count)
+	return float64(count)
+}
+
+// graphDo sends a request to Microsoft Graph and records its latency under the given endpoint label
+func graphDo(endpoint string, request *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(request.Context(), fmt.Sprint("graph ", endpoint), spanKindInternal)
+	defer span.End()
+
+	start := time.Now()
+	response, err := doWithTimeout(request.WithContext(ctx), graphTimeout)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(response.StatusCode)
+	} else {
+		span.RecordError(err)
+	}
+	graphRequestDuration.Observe(time.Since(start).Seconds(), endpoint, status)
+	span.SetAttribute("http.response.status_code", status)
+
+	return response, err
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"time"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// requestIDMiddleware tags every request with an ID, taken from X-Request-Id when the caller provides one,
+// and echoes it back so that clients can correlate their requests with our logs and the AAD/Graph ones
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if _, err := uuid.Parse(id); err != nil {
+			id = fmt.Sprint(uuid.New())
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(withRequestID(r.Context(), id)))
+	})
+}
+
+// tracingMiddleware opens a server span for every request, continuing the caller's trace when a traceparent header is sent
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := contextWithRemoteParent(r.Context(), r.Header.Get(traceparentHeader))
+		ctx, span := tracer.Start(ctx, fmt.Sprint(r.Method, " ", r.URL.Path), spanKindServer)
+		defer span.End()
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("request.id", requestID(ctx))
+
+		rw := statusWriter(w)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		status := rw.Status()
+		span.SetAttribute("http.response.status_code", status)
+		if status >= 500 {
+			span.SetStatus(spanStatusError, http.StatusText(status))
+		}
+	})
+}
+
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := statusWriter(w)
+		next.ServeHTTP(rw, r)
+
+		loggerFromContext(r.Context()).Info("request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rw.Status(),
+			"duration_ms", time.Since(start).Seconds()*1000,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+// requestIDTransport sends the inbound request ID to Azure AD and Graph as client-request-id,
+// or a fresh one for calls made outside of a request
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	id := requestID(r.Context())
+	if id == "" {
+		id = fmt.Sprint(uuid.Must(uuid.NewRandom()))
+	}
+
+	// a RoundTripper must not modify the caller's request
+	outbound := r.Clone(r.Context())
+	outbound.Header.Set("client-request-id", id)
+	outbound.Header.Set("client-return-client-request-id", "true")
+
+	return t.base.RoundTrip(outbound)
+}
+
+// tracingTransport records a client span for every outbound call and propagates the trace context
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(r.Context(), fmt.Sprint("HTTP ", r.Method), spanKindClient)
+	defer span.End()
+
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("server.address", r.URL.Host)
+	span.SetAttribute("url.path", r.URL.Path)
+
+	outbound := r.Clone(ctx)
+	outbound.Header.Set(traceparentHeader, span.traceparent())
+
+	response, err := t.base.RoundTrip(outbound)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttribute("http.response.status_code", response.StatusCode)
+	if response.StatusCode >= 400 {
+		span.SetStatus(spanStatusError, response.Status)
+	}
+	return response, nil
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"github.com/jinzhu/gorm"
-	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/oauth2"
+	"strings"
 	"time"
 )
 
@@ -15,14 +16,39 @@ type Model struct {
 	UpdatedAt time.Time
 }
 
+// User status: disabled users can not log in or use their tokens, deleted users are soft deleted as well
+// and only the admin API still sees them
+const (
+	userActive   = "active"
+	userDisabled = "disabled"
+	userDeleted  = "deleted"
+)
+
 type User struct {
 	gorm.Model
-	AzureId           string
-	Name              string
-	AccessToken       string
-	RefreshToken      string
-	ClientPublicToken string
-	TemporaryToken    string
+	Status       string `gorm:"default:'active'"`
+	AzureId      string
+	Name         string
+	Email        string
+	AccessToken  string
+	RefreshToken string
+	LastLoginAt  *time.Time
+	// the session the user was found by or just signed in with, stored in client_sessions
+	Session ClientSession `gorm:"-"`
+}
+
+// ClientSession is the sign in of a user at one registered client application: the temporary token
+// until the client exchanges it, then the public token. Signing in at another client does not touch it.
+type ClientSession struct {
+	ID                      uint `gorm:"primary_key"`
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+	UserId                  uint   `gorm:"unique_index:idx_client_sessions_user_client"`
+	ClientId                string `gorm:"unique_index:idx_client_sessions_user_client"`
+	PublicToken             string `gorm:"index"`
+	PublicTokenExpiresAt    *time.Time
+	TemporaryToken          string `gorm:"index"`
+	TemporaryTokenExpiresAt *time.Time
 }
 
 type AzureUserInfo struct {
@@ -40,6 +66,14 @@ type AzureUserInfo struct {
 	ID                string        `json:"id"`
 }
 
+// email falls back to the UPN for accounts without a mailbox
+func (ui *AzureUserInfo) email() string {
+	if ui.Mail != "" {
+		return ui.Mail
+	}
+	return ui.UserPrincipalName
+}
+
 type refreshTokenResponse struct {
 	TokenType    string `json:"token_type"`
 	Scope        string `json:"scope"`
@@ -54,76 +88,332 @@ type refreshTokenResponse struct {
 
 type OToken struct {
 	*oauth2.Token
-	TemporaryToken string
-	PublicToken    string
+	TemporaryToken          string
+	PublicToken             string
+	ClientId                string
+	TemporaryTokenExpiresAt *time.Time
+	PublicTokenExpiresAt    *time.Time
 }
 
-func InitDB() *gorm.DB {
-	if !*devEnv {
-		connStr = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-			getenv("DB_HOST"), getenv("DB_PORT"), getenv("DB_USER"), getenv("DB_PASSWORD"), getenv("DB_NAME"))
-		dialect = "postgres"
+func FindUserByTempToken(ctx context.Context, token string) User {
+	return findUserBySession(ctx, "temporary_token", token)
+}
+func FindUserByPubToken(ctx context.Context, token string) User {
+	return findUserBySession(ctx, "public_token", token)
+}
 
+// findUserBySession finds the active user holding the token in the column of client_sessions,
+// with the session it was found in
+func findUserBySession(ctx context.Context, column, token string) (user User) {
+	user = User{}
+	// an empty token would match every session that has already exchanged or revoked it
+	if token == "" {
+		return
 	}
-
-	db, err := gorm.Open(dialect, connStr)
-	if err != nil {
-		panic(err)
+	session := ClientSession{}
+	dbFrom(ctx).Where(column+"_expires_at IS NULL OR "+column+"_expires_at > ?", time.Now()).
+		Find(&session, column+" = ?", token)
+	if session.ID != 0 {
+		dbFrom(ctx).Where("status = ?", userActive).Find(&user, "id = ?", session.UserId)
 	}
-	if db == nil {
-		panic("db nil")
+	if user.ID == 0 {
+		failedLookup(ctx)
+		return User{}
 	}
-	db.AutoMigrate(&User{})
-	return db
+	user.Session = session
+	return
 }
 
-func FindUserByTempToken(token string) (user User) {
+// FindUserById also returns disabled users, callers issuing tokens check Active
+func FindUserById(ctx context.Context, id uint) (user User) {
 	user = User{}
-	db.Find(&user, "temporary_token = ?", token)
+	dbFrom(ctx).Find(&user, "id = ?", id)
 	return
 }
-func FindUserByPubToken(token string) (user User) {
+
+// FindUserWithDeleted returns the user whatever the status, for the admin API
+func FindUserWithDeleted(ctx context.Context, id uint) (user User) {
 	user = User{}
-	db.Find(&user, "client_public_token = ?", token)
+	dbFrom(ctx).Unscoped().Find(&user, "id = ?", id)
+	return
+}
+
+func FindUserByAzureId(ctx context.Context, azureId string) (user User) {
+	user = User{}
+	if azureId == "" {
+		return
+	}
+	dbFrom(ctx).Where("status = ?", userActive).Find(&user, "azure_id = ?", azureId)
 	return
 }
 
-func (user *User) UpdateToken(t *OToken) {
+// Active is false for disabled and deleted users, users from before the status column count as active
+func (user *User) Active() bool {
+	return user.Status == userActive || user.Status == ""
+}
+
+// SetStatus disables, soft deletes or restores the user, revoking the sessions unless the user becomes active
+func (user *User) SetStatus(ctx context.Context, status string) {
+	if status != userActive {
+		user.RevokeSessions(ctx)
+	}
+
+	updates := map[string]interface{}{"status": status, "deleted_at": nil}
+	if status == userDeleted {
+		updates["deleted_at"] = time.Now()
+	}
+	dbFrom(ctx).Unscoped().Model(user).Updates(updates)
+	user.Status = status
+}
+
+// UpdateToken keeps the Azure AD tokens and the client session of t, false when the user is no longer active
+func (user *User) UpdateToken(ctx context.Context, t *OToken) bool {
+	return user.updateToken(ctx, t, map[string]interface{}{})
+}
+
+// updateToken writes just the changed columns and only while the user is active, saving the whole user
+// would put back a status or tokens changed since it was loaded
+func (user *User) updateToken(ctx context.Context, t *OToken, updates map[string]interface{}) bool {
 	if t.AccessToken != "" {
 		user.AccessToken = t.AccessToken
+		updates["access_token"] = t.AccessToken
 	}
-	user.TemporaryToken = t.TemporaryToken
-	user.ClientPublicToken = t.PublicToken
+	if t.RefreshToken != "" {
+		user.RefreshToken = t.RefreshToken
+		updates["refresh_token"] = t.RefreshToken
+	}
+
+	if !user.updateIfActive(ctx, updates) {
+		return false
+	}
+	user.saveSession(ctx, t)
+	return true
+}
 
-	db.Save(&user)
+// updateIfActive updates the columns given unless the user was disabled or deleted in the meantime
+func (user *User) updateIfActive(ctx context.Context, updates map[string]interface{}) bool {
+	result := dbFrom(ctx).Model(&User{}).Where("id = ? AND status = ?", user.ID, userActive).Updates(updates)
+	return result.Error == nil && result.RowsAffected > 0
 }
 
-func FindOrCreateUser(token *OToken, userInfo *AzureUserInfo) User {
+// saveSession replaces the tokens of the user's session at the client of t, the sessions at other clients stay
+func (user *User) saveSession(ctx context.Context, t *OToken) {
+	session := ClientSession{UserId: user.ID, ClientId: t.ClientId}
+	if t.PublicToken == "" && t.TemporaryToken == "" {
+		// OpenID Connect logins have no session of their own, they end the one at the client
+		dbFrom(ctx).Where("user_id = ? AND client_id = ?", user.ID, t.ClientId).Delete(&ClientSession{})
+		user.Session = session
+		return
+	}
+	// a map, a struct would leave out the empty client id of sessions from before registered clients
+	dbFrom(ctx).Where(map[string]interface{}{"user_id": user.ID, "client_id": t.ClientId}).
+		Assign(map[string]interface{}{
+			"public_token":               t.PublicToken,
+			"public_token_expires_at":    t.PublicTokenExpiresAt,
+			"temporary_token":            t.TemporaryToken,
+			"temporary_token_expires_at": t.TemporaryTokenExpiresAt,
+		}).FirstOrCreate(&session)
+	user.Session = session
+}
+
+func FindOrCreateUser(ctx context.Context, token *OToken, userInfo *AzureUserInfo) User {
 	user := User{}
-	db.Find(&user, "azure_id = ?", userInfo.ID)
-	if (User{} != user) {
-		user.UpdateToken(token)
+	// deleted users are found as well, so that they do not come back as a new user
+	dbFrom(ctx).Unscoped().Find(&user, "azure_id = ?", userInfo.ID)
+	if user.ID != 0 && !user.Active() {
+		return user
+	}
+	now := time.Now()
+	user.LastLoginAt = &now
+	if user.ID != 0 {
+		changed := user.Name != userInfo.DisplayName || user.Email != userInfo.email()
+		user.Name = userInfo.DisplayName
+		user.Email = userInfo.email()
+		updated := user.updateToken(ctx, token, map[string]interface{}{
+			"name": user.Name, "email": user.Email, "last_login_at": user.LastLoginAt,
+		})
+		if !updated {
+			// disabled or deleted since it was found
+			current := User{}
+			dbFrom(ctx).Unscoped().Find(&current, "id = ?", user.ID)
+			return current
+		}
+		if changed {
+			notifyWebhooks(ctx, webhookUserUpdated, user)
+		}
 		return user
 	}
-	user.Create(token, userInfo)
+	user.Create(ctx, token, userInfo)
 
 	return user
 }
 
-func RefreshToken(user *User, r refreshTokenResponse) {
+// RefreshToken keeps the tokens Azure AD refreshed, false when the user is no longer active
+func RefreshToken(ctx context.Context, user *User, r refreshTokenResponse) bool {
 	user.AccessToken = r.AccessToken
 	user.RefreshToken = r.RefreshToken
 
-	db.Save(&user)
+	return user.updateIfActive(ctx, map[string]interface{}{"access_token": r.AccessToken, "refresh_token": r.RefreshToken})
+}
+
+// SaveRefreshToken keeps the refresh token Azure AD rotated while redeeming it for another resource
+func (user *User) SaveRefreshToken(ctx context.Context, refreshToken string) {
+	if refreshToken == "" || refreshToken == user.RefreshToken {
+		return
+	}
+	user.RefreshToken = refreshToken
+	dbFrom(ctx).Model(user).Update("refresh_token", refreshToken)
+}
+
+// ClaimTemporaryToken clears the temporary token of the session the user was found by, false when another
+// exchange has already taken it or it has expired since
+func (user *User) ClaimTemporaryToken(ctx context.Context, token string) bool {
+	result := dbFrom(ctx).Model(&ClientSession{}).
+		Where("id = ? AND temporary_token = ?", user.Session.ID, token).
+		Where("temporary_token_expires_at IS NULL OR temporary_token_expires_at > ?", time.Now()).
+		Updates(map[string]interface{}{"temporary_token": "", "temporary_token_expires_at": nil})
+	return token != "" && result.Error == nil && result.RowsAffected > 0
+}
+
+// RevokePublicToken ends the session the user was found by, the user has to log in again at that client
+func (user *User) RevokePublicToken(ctx context.Context) {
+	if user.Session.ID != 0 {
+		dbFrom(ctx).Delete(&ClientSession{}, "id = ?", user.Session.ID)
+	}
+	user.Session = ClientSession{}
 }
 
-func (user *User) Create(t *OToken, ui *AzureUserInfo) {
+func (user *User) Create(ctx context.Context, t *OToken, ui *AzureUserInfo) {
 	user.AccessToken = t.AccessToken
-	user.TemporaryToken = t.TemporaryToken
-	user.ClientPublicToken = t.PublicToken
 	user.RefreshToken = t.RefreshToken
 	user.Name = ui.DisplayName
+	user.Email = ui.email()
 	user.AzureId = ui.ID
+	user.Status = userActive
+
+	dbFrom(ctx).Create(&user)
+	user.saveSession(ctx, t)
+	notifyWebhooks(ctx, webhookUserCreated, *user)
+}
+
+// Session is one way a user is signed in: the public token of a client, a temporary token not yet exchanged
+// or an OpenID Connect refresh token
+type Session struct {
+	Type      string     `json:"type"`
+	Id        uint       `json:"id,omitempty"`
+	ClientId  string     `json:"client_id"`
+	Scope     string     `json:"scope,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// SearchUsers matches the query against name, email and Azure id, deleted users included, newest users first
+func SearchUsers(ctx context.Context, query, status string, limit, offset int) (users []User, total int) {
+	scope := dbFrom(ctx).Unscoped().Model(&User{})
+	if status != "" {
+		scope = scope.Where("status = ?", status)
+	}
+	if query != "" {
+		pattern := fmt.Sprint("%", strings.ToLower(query), "%")
+		scope = scope.Where("LOWER(name) LIKE ? OR LOWER(email) LIKE ? OR azure_id = ?", pattern, pattern, query)
+	}
+	scope.Count(&total)
+	scope.Order("id DESC").Limit(limit).Offset(offset).Find(&users)
+	return
+}
 
-	db.Create(&user)
+// Sessions lists the sessions that are still valid
+func (user *User) Sessions(ctx context.Context) []Session {
+	sessions := []Session{}
+	now := time.Now()
+	var clientSessions []ClientSession
+	dbFrom(ctx).Where("user_id = ?", user.ID).Order("id").Find(&clientSessions)
+	for _, s := range clientSessions {
+		createdAt := s.CreatedAt
+		if s.PublicToken != "" && (s.PublicTokenExpiresAt == nil || s.PublicTokenExpiresAt.After(now)) {
+			sessions = append(sessions, Session{Type: "public_token", Id: s.ID, ClientId: s.ClientId,
+				CreatedAt: &createdAt, ExpiresAt: s.PublicTokenExpiresAt})
+		}
+		if s.TemporaryToken != "" && (s.TemporaryTokenExpiresAt == nil || s.TemporaryTokenExpiresAt.After(now)) {
+			sessions = append(sessions, Session{Type: "temporary_token", Id: s.ID, ClientId: s.ClientId,
+				CreatedAt: &createdAt, ExpiresAt: s.TemporaryTokenExpiresAt})
+		}
+	}
+
+	var tokens []OidcRefreshToken
+	dbFrom(ctx).Where("user_id = ? AND revoked = ? AND expires_at > ?", user.ID, false, now).Order("id").Find(&tokens)
+	for _, token := range tokens {
+		createdAt, expiresAt := token.CreatedAt, token.ExpiresAt
+		sessions = append(sessions, Session{Type: "refresh_token", Id: token.ID, ClientId: token.ClientId,
+			Scope: token.Scope, CreatedAt: &createdAt, ExpiresAt: &expiresAt})
+	}
+	return sessions
+}
+
+// RevokeSessions signs the user out everywhere: the public and temporary tokens of every client, the OpenID Connect
+// refresh tokens and authorization codes, and the cached downstream tokens
+func (user *User) RevokeSessions(ctx context.Context) {
+	user.Session = ClientSession{}
+	dbFrom(ctx).Where("user_id = ?", user.ID).Delete(&ClientSession{})
+	dbFrom(ctx).Model(&OidcRefreshToken{}).Where("user_id = ? AND revoked = ?", user.ID, false).Update("revoked", true)
+	dbFrom(ctx).Model(&AuthorizationCode{}).Where("user_id = ? AND used = ?", user.ID, false).Update("used", true)
+	userTokens.Delete(fmt.Sprint(user.ID, " "))
+}
+
+// PurgeAzureTokens deletes the Azure AD tokens stored for the user, Graph and downstream calls
+// fail until the user logs in again
+func (user *User) PurgeAzureTokens(ctx context.Context) {
+	user.AccessToken, user.RefreshToken = "", ""
+	dbFrom(ctx).Unscoped().Model(user).Updates(map[string]interface{}{"access_token": "", "refresh_token": ""})
+	userTokens.Delete(fmt.Sprint(user.ID, " "))
+}
+
+// Delete removes the user for good, with the client sessions and the OpenID Connect codes and refresh tokens issued to them
+func (user *User) Delete(ctx context.Context) {
+	dbFrom(ctx).Where("user_id = ?", user.ID).Delete(&ClientSession{})
+	dbFrom(ctx).Unscoped().Where("user_id = ?", user.ID).Delete(&OidcRefreshToken{})
+	dbFrom(ctx).Unscoped().Where("user_id = ?", user.ID).Delete(&AuthorizationCode{})
+	dbFrom(ctx).Unscoped().Delete(user)
+	userTokens.Delete(fmt.Sprint(user.ID, " "))
+}
+
+// migrateClientSessions moves the sessions kept in the users table before client_sessions into it, once.
+// Columns added to users later are missing when upgrading from an older version.
+func migrateClientSessions(db *gorm.DB) {
+	if !db.Dialect().HasColumn("users", "client_public_token") {
+		return
+	}
+	column := func(name, missing string) string {
+		if db.Dialect().HasColumn("users", name) {
+			return name
+		}
+		return missing
+	}
+	rows, err := db.Raw(fmt.Sprint("SELECT id, ", column("client_id", "''"), ", client_public_token, ",
+		column("client_public_token_expires_at", "NULL"), ", temporary_token, ", column("temporary_token_expires_at", "NULL"),
+		" FROM users WHERE client_public_token <> '' OR temporary_token <> ''")).Rows()
+	handleError(err)
+	var sessions []ClientSession
+	for rows.Next() {
+		var session ClientSession
+		// columns added by AutoMigrate are NULL in the rows that existed before
+		var clientId, publicToken, temporaryToken sql.NullString
+		handleError(rows.Scan(&session.UserId, &clientId, &publicToken, &session.PublicTokenExpiresAt,
+			&temporaryToken, &session.TemporaryTokenExpiresAt))
+		session.ClientId, session.PublicToken, session.TemporaryToken = clientId.String, publicToken.String, temporaryToken.String
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+
+	// in one transaction, so that a failed migration is run again from the start
+	tx := db.Begin()
+	for _, session := range sessions {
+		handleError(tx.Create(&session).Error)
+	}
+	handleError(tx.Exec("UPDATE users SET client_public_token = '', temporary_token = '' " +
+		"WHERE client_public_token <> '' OR temporary_token <> ''").Error)
+	handleError(tx.Commit().Error)
+	if len(sessions) > 0 {
+		logger.Info("Moved sessions to client_sessions", "count", len(sessions))
+	}
 }
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/microsoft"
@@ -15,39 +18,163 @@ import (
 var (
 	xOauth2Config = oauth2.Config{
 		ClientID:     ClientIdConst,
-		ClientSecret: ClientSecretConst,
+		ClientSecret: oauth2ClientSecret(),
 		RedirectURL:  fmt.Sprint(BaseUrl, RedirectPath),
-		Endpoint:     microsoft.AzureADEndpoint(TenantConst),
+		Endpoint:     azureADEndpoint(),
 		Scopes:       OuathScopes,
 	}
 )
 
+// azureADEndpoint always sends the client credentials as form parameters, so that an empty
+// ClientSecret is left out when authenticating with a certificate
+func azureADEndpoint() oauth2.Endpoint {
+	endpoint := microsoft.AzureADEndpoint(TenantConst)
+	endpoint.AuthStyle = oauth2.AuthStyleInParams
+	return endpoint
+}
+
 func oauthUrlHandler(w http.ResponseWriter, r *http.Request) {
 	authUrl := fmt.Sprint(BaseUrl, "/auth")
-	fmt.Fprintf(w, authUrl)
+	params := url.Values{}
+	for _, key := range []string{"client_id", "return_to", "response_mode", "scope"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	if len(params) > 0 {
+		authUrl = fmt.Sprint(authUrl, "?", params.Encode())
+	}
+	fmt.Fprint(w, authUrl)
 }
 
 // Auth handler which will redirect to AAD
+// client_id is the registered client application starting the login,
+// return_to selects where the temporary token is delivered, it must match the client redirect URIs or RETURN_URL_ALLOWLIST,
+// and response_mode how: query (default), fragment, form_post, web_message or cookie for a session cookie instead
 func oauthHandler(w http.ResponseWriter, r *http.Request) {
-	state := randToken(48)
-	authorizationURL := xOauth2Config.AuthCodeURL(state)
-	http.Redirect(w, r, authorizationURL, 301)
+	query := r.URL.Query()
+	c := FindClient(r.Context(), query.Get("client_id"))
+	if (Client{} == c) {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	returnTo, err := resolveReturnURL(c, query.Get("return_to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	responseMode, err := resolveResponseMode(c, query.Get("response_mode"), returnTo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scopes, err := c.ValidateScopes(query.Get("scope"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	startAADLogin(w, r, loginState{ClientId: c.ClientId, ReturnTo: returnTo, ResponseMode: responseMode}, scopes)
+}
+
+// startAADLogin sends the browser to Azure AD, the login state comes back to aadAuthHandler
+func startAADLogin(w http.ResponseWriter, r *http.Request, login loginState, scopes []string) {
+	loginsTotal.Inc("started")
+	audit(r.Context(), AuditEvent{Event: auditLoginStarted, ClientId: login.ClientId})
+	state := encodeState(randToken(48), login)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "state",
+		Value:    state,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(BaseUrl, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	config := xOauth2Config
+	config.Scopes = append(append([]string{}, OuathScopes...), scopes...)
+	authorizationURL := config.AuthCodeURL(state)
+	// not 301: a cached redirect would replay a stale state
+	http.Redirect(w, r, authorizationURL, http.StatusFound)
+}
+
+// loginFailed counts and audits a callback that did not end with a signed-in user
+func loginFailed(ctx context.Context, reason, clientId string) {
+	callbackFailuresTotal.Inc(reason)
+	audit(ctx, AuditEvent{Event: auditLoginFailed, Outcome: auditFailure, Reason: reason, ClientId: clientId})
 }
 
 // process the redirection from AAD
 func aadAuthHandler(w http.ResponseWriter, r *http.Request) {
 	authorizationCode := r.URL.Query().Get("code")
 
+	// the state is not signed, only the cookie set by startAADLogin ties it to this browser,
+	// so a callback without the cookie is refused as well
+	state := r.URL.Query().Get("state")
 	ck, err := r.Cookie("state")
-	if err == nil && (r.URL.Query().Get("state") != ck.Value) {
-		fmt.Fprintf(w, "Error: State is not the same")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(ck.Value)) != 1 {
+		loginFailed(r.Context(), "state_mismatch", "")
+		http.Error(w, "Error: State is not the same", http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "state", Path: "/", MaxAge: -1})
+
+	login, err := decodeState(state)
+	if aadError := r.URL.Query().Get("error"); aadError != "" {
+		loginFailed(r.Context(), "aad_error", login.ClientId)
+		if err == nil && login.DeviceUserCode != "" {
+			denyDeviceLogin(r.Context(), login.DeviceUserCode)
+		}
+		http.Error(w, fmt.Sprint("Error: ", aadError, " ", r.URL.Query().Get("error_description")), http.StatusBadRequest)
+		return
+	}
+
+	// validated again in case the allowlist changed while the user was signing in
+	c := FindClient(r.Context(), login.ClientId)
+	if err == nil && (Client{} == c) {
+		err = errInvalidClient
+	}
+	if err == nil {
+		login.ReturnTo, err = resolveReturnURL(c, login.ReturnTo)
+	}
+	if err == nil && login.Authorize == nil {
+		login.ResponseMode, err = resolveResponseMode(c, login.ResponseMode, login.ReturnTo)
 	}
-	oAuthToken, err := xOauth2Config.Exchange(context.Background(), authorizationCode)
 	if err != nil {
+		loginFailed(r.Context(), "invalid_state", login.ClientId)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options, err := exchangeOptions(xOauth2Config.Endpoint.TokenURL)
+	handleError(err)
+
+	ctx, span := tracer.Start(r.Context(), "oauth.exchange", spanKindInternal)
+	ctx, cancel := context.WithTimeout(ctx, tokenTimeout)
+	oAuthToken, err := xOauth2Config.Exchange(context.WithValue(ctx, oauth2.HTTPClient, &client), authorizationCode, options...)
+	cancel()
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		loginFailed(r.Context(), "code_exchange", login.ClientId)
+		loggerFromContext(r.Context()).Error("Can not exchange authorization code", "error", err)
+		// the oauth2 package flattens transport errors, an open circuit included, into plain errors
+		if _, rejected := err.(*oauth2.RetrieveError); !rejected {
+			err = &UnavailableError{Host: authority.Host, RetryAfter: defaultRetryAfter}
+		}
+		if upstreamUnavailable(w, r, nil, err) {
+			return
+		}
 		panic(err)
 	}
 
-	meResponse := getMeRequest(oAuthToken.AccessToken)
+	meResponse, err := getMeRequest(r.Context(), oAuthToken.AccessToken)
+	if upstreamUnavailable(w, r, meResponse, err) {
+		return
+	}
+	handleError(err)
 	defer meResponse.Body.Close()
 
 	var azureUserInfo AzureUserInfo
@@ -57,19 +184,58 @@ func aadAuthHandler(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(meBytes, &azureUserInfo)
 	handleError(err)
 
-	token := OToken{Token: oAuthToken, PublicToken: "", TemporaryToken: fmt.Sprint(uuid.New())}
+	token := OToken{
+		Token:                   oAuthToken,
+		PublicToken:             "",
+		TemporaryToken:          fmt.Sprint(uuid.New()),
+		ClientId:                c.ClientId,
+		TemporaryTokenExpiresAt: tokenExpiry(c.TemporaryTokenTtl),
+	}
+	if login.Authorize != nil {
+		// OpenID Connect clients get an authorization code instead
+		token.TemporaryToken = ""
+		token.TemporaryTokenExpiresAt = nil
+	}
+	if login.ResponseMode == responseModeCookie && login.Authorize == nil && login.DeviceUserCode == "" {
+		// the session cookie carries the public token right away
+		token.TemporaryToken = ""
+		token.TemporaryTokenExpiresAt = nil
+		token.PublicToken = fmt.Sprint(uuid.New())
+		token.PublicTokenExpiresAt = tokenExpiry(c.PublicTokenTtl)
+	}
 
-	user := FindOrCreateUser(&token, &azureUserInfo)
+	user := FindOrCreateUser(r.Context(), &token, &azureUserInfo)
 	authUrl := fmt.Sprint(BaseUrl, "/auth")
 	if (User{} == user) {
+		loginFailed(r.Context(), "user_not_found", login.ClientId)
 		http.Redirect(w, r, authUrl, http.StatusNotFound)
+		return
 	}
+	if !user.Active() {
+		loginFailed(r.Context(), "user_disabled", c.ClientId)
+		http.Error(w, "The account is disabled", http.StatusForbidden)
+		return
+	}
+	loginsTotal.Inc("completed")
+	auditUser(r.Context(), auditLoginCompleted, user, nil)
+	notifyWebhooks(r.Context(), webhookUserLogin, user)
 
-	tempTokenURL := generateTempTokenUrl(token.TemporaryToken)
-	http.Redirect(w, r, tempTokenURL, 301)
+	if login.Authorize != nil {
+		completeAuthorize(w, r, user, login)
+		return
+	}
+	if login.DeviceUserCode != "" {
+		completeDeviceLogin(w, r, login.DeviceUserCode, token.TemporaryToken)
+		return
+	}
+	if login.ResponseMode == responseModeCookie {
+		deliverSession(w, r, login, user)
+		return
+	}
+	deliverTempToken(w, r, login, token.TemporaryToken)
 }
 
-func getMeRequest(token string) *http.Response {
+func getMeRequest(ctx context.Context, token string) (*http.Response, error) {
 	meRequest, err := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/me", nil)
 	if err != nil {
 		panic(fmt.Errorf("ERROR: %s", err))
@@ -78,29 +244,64 @@ func getMeRequest(token string) *http.Response {
 	tokenStr := fmt.Sprint("Bearer ", token)
 	meRequest.Header.Set("Authorization", tokenStr)
 
-	meResponse, err := client.Do(meRequest)
-
-	if err != nil {
-		panic(fmt.Errorf("ERROR: %s", err))
-	}
-
-	return meResponse
+	return graphDo("me", meRequest.WithContext(ctx))
 }
 
+// exchanges the temporary token for a public token, only for the client the login was started by;
+// confidential clients also authenticate with client_secret or HTTP basic auth
 func authWithTempTokenHandler(w http.ResponseWriter, r *http.Request) {
-	keys := r.URL.Query()
+	// accepted in the query string or, as sent by the form_post response mode, in a form body
+	temporaryToken := r.FormValue("temporary_token")
 
-	temporaryToken := keys.Get("temporary_token")
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	c := FindClient(r.Context(), clientId)
+	if (Client{} == c) {
+		audit(r.Context(), AuditEvent{Event: auditTokenExchange, Outcome: auditFailure, Reason: "unknown_client", ClientId: clientId})
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if err := c.Authenticate(clientSecret); err != nil {
+		failedLookup(r.Context())
+		audit(r.Context(), AuditEvent{Event: auditTokenExchange, Outcome: auditFailure, Reason: "invalid_client", ClientId: clientId})
+		http.Error(w, "Invalid client credentials", http.StatusUnauthorized)
+		return
+	}
 
-	user := FindUserByTempToken(temporaryToken)
+	user := exchangeTempToken(r.Context(), c, temporaryToken)
 	if (user == User{}) {
+		audit(r.Context(), AuditEvent{Event: auditTokenExchange, Outcome: auditFailure, Reason: "invalid_token", ClientId: clientId})
 		http.Error(w, "Record not found", http.StatusNotFound)
 		return
 	}
+	auditUser(r.Context(), auditTokenExchange, user, nil)
 
-	var oAuthToken oauth2.Token
-	token := OToken{Token: &oAuthToken, PublicToken: fmt.Sprint(uuid.New()), TemporaryToken: ""}
-	user.UpdateToken(&token)
+	fmt.Fprint(w, user.Session.PublicToken)
+}
+
+// exchangeTempToken replaces the temporary token issued to the client with a public token
+func exchangeTempToken(ctx context.Context, c Client, temporaryToken string) User {
+	user := FindUserByTempToken(ctx, temporaryToken)
+	if (user == User{}) || user.Session.ClientId != c.ClientId {
+		return User{}
+	}
+	// only one of concurrent exchanges of the same token gets a public token
+	if !user.ClaimTemporaryToken(ctx, temporaryToken) {
+		return User{}
+	}
 
-	fmt.Fprintf(w, user.ClientPublicToken)
+	var oAuthToken oauth2.Token
+	token := OToken{
+		Token:                &oAuthToken,
+		PublicToken:          fmt.Sprint(uuid.New()),
+		TemporaryToken:       "",
+		ClientId:             c.ClientId,
+		PublicTokenExpiresAt: tokenExpiry(c.PublicTokenTtl),
+	}
+	if !user.UpdateToken(ctx, &token) {
+		return User{}
+	}
+	return user
 }
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OpenID Connect provider: internal applications log in with any OIDC client library,
+// the users still authenticate against Azure AD through aadAuthHandler
+
+const (
+	authorizationCodeTtl  = time.Minute
+	idTokenTtl            = time.Hour
+	defaultAccessTokenTtl = time.Hour
+
+	accessTokenType = "at+jwt"
+)
+
+var (
+	refreshTokenTtl = getenvDuration("OIDC_REFRESH_TOKEN_TTL", 30*24*time.Hour)
+
+	supportedOidcScopes = []string{"openid", "profile", "email", "offline_access"}
+)
+
+type authorizeRequest struct {
+	State               string `json:"state,omitempty"`
+	Nonce               string `json:"nonce,omitempty"`
+	Scope               string `json:"scope"`
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+type oidcError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func openidConfigurationHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                BaseUrl,
+		"authorization_endpoint":                fmt.Sprint(BaseUrl, "/authorize"),
+		"token_endpoint":                        fmt.Sprint(BaseUrl, "/token"),
+		"userinfo_endpoint":                     fmt.Sprint(BaseUrl, "/userinfo"),
+		"jwks_uri":                              fmt.Sprint(BaseUrl, "/jwks"),
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      supportedOidcScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "nonce", "name", "email", "oid"},
+	})
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []jwk{publicJWK(&signingKey.Private.PublicKey, signingKey.Kid)},
+	})
+}
+
+// authorizeHandler validates the authorization request and starts the Azure AD login
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// without a valid client and redirect URI errors can not be sent back to the client
+	c := FindClient(r.Context(), query.Get("client_id"))
+	if (Client{} == c) {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectUri := query.Get("redirect_uri")
+	if redirectUri == "" {
+		http.Error(w, "redirect_uri is required", http.StatusBadRequest)
+		return
+	}
+	redirectUri, err := resolveReturnURL(c, redirectUri)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request := &authorizeRequest{
+		State:               query.Get("state"),
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+	fail := func(code, description string) {
+		redirectWithParams(w, r, redirectUri, url.Values{
+			"error": {code}, "error_description": {description}, "state": {request.State},
+		})
+	}
+
+	if query.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the code response type is supported")
+		return
+	}
+	if mode := query.Get("response_mode"); mode != "" && mode != "query" {
+		fail("invalid_request", "only the query response mode is supported")
+		return
+	}
+
+	scopes := filterOidcScopes(query.Get("scope"))
+	if !containsString(scopes, "openid") {
+		fail("invalid_scope", "the openid scope is required")
+		return
+	}
+	request.Scope = strings.Join(scopes, " ")
+
+	if request.CodeChallenge != "" && request.CodeChallengeMethod != "S256" {
+		fail("invalid_request", "code_challenge_method must be S256")
+		return
+	}
+	if request.CodeChallenge == "" && !c.IsConfidential() {
+		fail("invalid_request", "public clients must use PKCE")
+		return
+	}
+
+	startAADLogin(w, r, loginState{ClientId: c.ClientId, ReturnTo: redirectUri, Authorize: request}, nil)
+}
+
+// completeAuthorize is called by aadAuthHandler once the user signed in to Azure AD
+func completeAuthorize(w http.ResponseWriter, r *http.Request, user User, login loginState) {
+	request := login.Authorize
+	code := AuthorizationCode{
+		ClientId:            login.ClientId,
+		UserId:              user.ID,
+		RedirectUri:         login.ReturnTo,
+		Scope:               request.Scope,
+		Nonce:               request.Nonce,
+		CodeChallenge:       request.CodeChallenge,
+		CodeChallengeMethod: request.CodeChallengeMethod,
+	}
+	value := code.Create(r.Context(), authorizationCodeTtl)
+
+	w.Header().Set("Cache-Control", "no-store")
+	redirectWithParams(w, r, login.ReturnTo, url.Values{"code": {value}, "state": {request.State}})
+}
+
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	c, ok := authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		authorizationCodeGrant(w, r, c)
+	case "refresh_token":
+		refreshTokenGrant(w, r, c)
+	default:
+		writeJSON(w, http.StatusBadRequest, oidcError{"unsupported_grant_type", ""})
+	}
+}
+
+// authenticateClient accepts client_secret_basic, client_secret_post and, for public clients, none
+func authenticateClient(w http.ResponseWriter, r *http.Request) (Client, bool) {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if ok {
+		// RFC 6749 form-encodes the credentials before the basic auth encoding
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	c := FindClient(r.Context(), clientId)
+	if (Client{} == c) || c.Authenticate(clientSecret) != nil {
+		failedLookup(r.Context())
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		writeJSON(w, http.StatusUnauthorized, oidcError{"invalid_client", ""})
+		return Client{}, false
+	}
+	return c, true
+}
+
+func authorizationCodeGrant(w http.ResponseWriter, r *http.Request, c Client) {
+	code := RedeemAuthorizationCode(r.Context(), r.PostFormValue("code"))
+	redirectUri, _ := normalizeReturnURL(r.PostFormValue("redirect_uri"))
+	if code.ID == 0 || code.ClientId != c.ClientId || code.RedirectUri != redirectUri {
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", "invalid authorization code"})
+		return
+	}
+	if !verifyCodeChallenge(code.CodeChallenge, r.PostFormValue("code_verifier")) {
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", "invalid code_verifier"})
+		return
+	}
+
+	user := FindUserById(r.Context(), code.UserId)
+	if (User{} == user) || !user.Active() {
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", "user no longer exists or is disabled"})
+		return
+	}
+
+	issueTokens(w, r, c, user, code.Scope, code.Nonce)
+}
+
+func refreshTokenGrant(w http.ResponseWriter, r *http.Request, c Client) {
+	token := RedeemRefreshToken(r.Context(), r.PostFormValue("refresh_token"))
+	if token.ID == 0 || token.ClientId != c.ClientId {
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", "invalid refresh token"})
+		return
+	}
+
+	user := FindUserById(r.Context(), token.UserId)
+	if (User{} == user) || !user.Active() {
+		writeJSON(w, http.StatusBadRequest, oidcError{"invalid_grant", "user no longer exists or is disabled"})
+		return
+	}
+
+	issueTokens(w, r, c, user, token.Scope, "")
+}
+
+func issueTokens(w http.ResponseWriter, r *http.Request, c Client, user User, scope string, nonce string) {
+	now := time.Now()
+	accessTokenTtl := c.PublicTokenTtl
+	if accessTokenTtl <= 0 {
+		accessTokenTtl = defaultAccessTokenTtl
+	}
+
+	accessToken, err := signingKey.Sign(accessTokenType, map[string]interface{}{
+		"iss":       BaseUrl,
+		"sub":       user.AzureId,
+		"aud":       BaseUrl,
+		"client_id": c.ClientId,
+		"scope":     scope,
+		"iat":       now.Unix(),
+		"exp":       now.Add(accessTokenTtl).Unix(),
+		"jti":       randomHex(16),
+	})
+	handleError(err)
+
+	idClaims := map[string]interface{}{
+		"iss": BaseUrl,
+		"sub": user.AzureId,
+		"aud": c.ClientId,
+		"iat": now.Unix(),
+		"exp": now.Add(idTokenTtl).Unix(),
+		"oid": user.AzureId,
+	}
+	if nonce != "" {
+		idClaims["nonce"] = nonce
+	}
+	for k, v := range userClaims(user, scope) {
+		idClaims[k] = v
+	}
+	idToken, err := signingKey.Sign("JWT", idClaims)
+	handleError(err)
+
+	response := tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(accessTokenTtl / time.Second),
+		IdToken:     idToken,
+		Scope:       scope,
+	}
+	if containsString(strings.Fields(scope), "offline_access") {
+		refreshToken := OidcRefreshToken{ClientId: c.ClientId, UserId: user.ID, Scope: scope}
+		response.RefreshToken = refreshToken.Create(r.Context(), refreshTokenTtl)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func userinfoHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := verifyAccessToken(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, err.Error()))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user := FindUserByAzureId(r.Context(), fmt.Sprint(claims["sub"]))
+	if (User{} == user) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	info := userClaims(user, fmt.Sprint(claims["scope"]))
+	info["sub"] = user.AzureId
+	writeJSON(w, http.StatusOK, info)
+}
+
+// verifyAccessToken checks an access token issued by /token, sent as a Bearer token
+func verifyAccessToken(r *http.Request) (map[string]interface{}, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	return signingKey.Verify(strings.TrimSpace(auth[7:]), accessTokenType)
+}
+
+func userClaims(user User, scope string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	scopes := strings.Fields(scope)
+	if containsString(scopes, "profile") {
+		claims["name"] = user.Name
+	}
+	if containsString(scopes, "email") && user.Email != "" {
+		claims["email"] = user.Email
+	}
+	return claims
+}
+
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// filterOidcScopes drops scopes this provider does not know, as OpenID Connect asks
+func filterOidcScopes(scope string) []string {
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if containsString(supportedOidcScopes, s) && !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, target string, params url.Values) {
+	u, err := url.Parse(target)
+	handleError(err)
+
+	query := u.Query()
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			query[k] = v
+		}
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// AuthorizationCode is issued by /authorize and redeemed once at /token
+type AuthorizationCode struct {
+	gorm.Model
+	CodeHash            string `gorm:"unique_index"`
+	ClientId            string
+	UserId              uint
+	RedirectUri         string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	ExpiresAt           time.Time
+	Used                bool
+}
+
+// OidcRefreshToken is rotated on every use of the refresh_token grant
+type OidcRefreshToken struct {
+	gorm.Model
+	TokenHash string `gorm:"unique_index"`
+	ClientId  string
+	UserId    uint
+	Scope     string
+	ExpiresAt time.Time
+	Revoked   bool
+}
+
+// codes and refresh tokens are stored hashed, like client secrets
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (code *AuthorizationCode) Create(ctx context.Context, ttl time.Duration) string {
+	value := fmt.Sprint(uuid.New(), uuid.New())
+	code.CodeHash = hashToken(value)
+	code.ExpiresAt = time.Now().Add(ttl)
+
+	dbFrom(ctx).Create(code)
+	return value
+}
+
+// RedeemAuthorizationCode marks the code as used; a code can only be redeemed once
+func RedeemAuthorizationCode(ctx context.Context, value string) (code AuthorizationCode) {
+	code = AuthorizationCode{}
+	if value == "" {
+		return
+	}
+	dbFrom(ctx).Where("expires_at > ? AND used = ?", time.Now(), false).Find(&code, "code_hash = ?", hashToken(value))
+	if code.ID == 0 {
+		failedLookup(ctx)
+		return AuthorizationCode{}
+	}
+
+	// the conditional update makes concurrent redemptions of the same code fail
+	result := dbFrom(ctx).Model(&AuthorizationCode{}).Where("id = ? AND used = ?", code.ID, false).Update("used", true)
+	if result.RowsAffected != 1 {
+		return AuthorizationCode{}
+	}
+	return
+}
+
+func (token *OidcRefreshToken) Create(ctx context.Context, ttl time.Duration) string {
+	value := fmt.Sprint(uuid.New(), uuid.New())
+	token.TokenHash = hashToken(value)
+	token.ExpiresAt = time.Now().Add(ttl)
+
+	dbFrom(ctx).Create(token)
+	return value
+}
+
+// RedeemRefreshToken revokes the refresh token and returns it, so that the caller can issue its replacement
+func RedeemRefreshToken(ctx context.Context, value string) (token OidcRefreshToken) {
+	token = OidcRefreshToken{}
+	if value == "" {
+		return
+	}
+	dbFrom(ctx).Where("expires_at > ? AND revoked = ?", time.Now(), false).Find(&token, "token_hash = ?", hashToken(value))
+	if token.ID == 0 {
+		failedLookup(ctx)
+		return OidcRefreshToken{}
+	}
+
+	result := dbFrom(ctx).Model(&OidcRefreshToken{}).Where("id = ? AND revoked = ?", token.ID, false).Update("revoked", true)
+	if result.RowsAffected != 1 {
+		return OidcRefreshToken{}
+	}
+	return
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testRedirectUri   = "https://app.example.com/callback"
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+// newTestClient registers a confidential client for testRedirectUri
+func newTestClient(t *testing.T) (Client, string) {
+	t.Helper()
+	c := Client{Name: "test", RedirectUris: testRedirectUri}
+	secret := c.Create(context.Background(), true)
+	return c, secret
+}
+
+func newTestCode(t *testing.T, c Client, user User) string {
+	t.Helper()
+	code := AuthorizationCode{
+		ClientId:            c.ClientId,
+		UserId:              user.ID,
+		RedirectUri:         testRedirectUri,
+		Scope:               "openid profile",
+		Nonce:               "nonce",
+		CodeChallenge:       testCodeChallenge,
+		CodeChallengeMethod: "S256",
+	}
+	return code.Create(context.Background(), authorizationCodeTtl)
+}
+
+func postToken(c Client, secret string, form url.Values) *httptest.ResponseRecorder {
+	form.Set("grant_type", "authorization_code")
+	form.Set("client_id", c.ClientId)
+	form.Set("client_secret", secret)
+	request := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	tokenHandler(recorder, request)
+	return recorder
+}
+
+func TestAuthorizationCodeGrant(t *testing.T) {
+	openTestDB(t)
+	c, secret := newTestClient(t)
+	other, otherSecret := newTestClient(t)
+	user := User{AzureId: "azure-id", Name: "Test User", Status: userActive}
+	db.Create(&user)
+
+	codeForm := func(code string) url.Values {
+		return url.Values{"code": {code}, "redirect_uri": {testRedirectUri}, "code_verifier": {testCodeVerifier}}
+	}
+
+	code := newTestCode(t, c, user)
+	response := postToken(c, secret, codeForm(code))
+	if response.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", response.Code, response.Body)
+	}
+	var tokens tokenResponse
+	json.Unmarshal(response.Body.Bytes(), &tokens)
+	claims, err := signingKey.Verify(tokens.IdToken, "JWT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["aud"] != c.ClientId || claims["sub"] != user.AzureId || claims["nonce"] != "nonce" || claims["name"] != user.Name {
+		t.Errorf("unexpected id_token claims %v", claims)
+	}
+	if _, err := signingKey.Verify(tokens.AccessToken, accessTokenType); err != nil {
+		t.Errorf("access token: %s", err)
+	}
+
+	if response := postToken(c, secret, codeForm(code)); response.Code != http.StatusBadRequest {
+		t.Errorf("reused code: got status %d", response.Code)
+	}
+
+	form := codeForm(newTestCode(t, c, user))
+	form.Set("code_verifier", testCodeVerifier+"x")
+	if response := postToken(c, secret, form); response.Code != http.StatusBadRequest {
+		t.Errorf("wrong code_verifier: got status %d", response.Code)
+	}
+
+	form = codeForm(newTestCode(t, c, user))
+	form.Del("code_verifier")
+	if response := postToken(c, secret, form); response.Code != http.StatusBadRequest {
+		t.Errorf("missing code_verifier: got status %d", response.Code)
+	}
+
+	form = codeForm(newTestCode(t, c, user))
+	form.Set("redirect_uri", "https://app.example.com/other")
+	if response := postToken(c, secret, form); response.Code != http.StatusBadRequest {
+		t.Errorf("wrong redirect_uri: got status %d", response.Code)
+	}
+
+	if response := postToken(other, otherSecret, codeForm(newTestCode(t, c, user))); response.Code != http.StatusBadRequest {
+		t.Errorf("code of another client: got status %d", response.Code)
+	}
+
+	if response := postToken(c, "wrong", codeForm(newTestCode(t, c, user))); response.Code != http.StatusUnauthorized {
+		t.Errorf("wrong client secret: got status %d", response.Code)
+	}
+}
+
+func TestAuthorizeRejectsPlainCodeChallenge(t *testing.T) {
+	openTestDB(t)
+	c, _ := newTestClient(t)
+
+	query := url.Values{
+		"client_id":             {c.ClientId},
+		"redirect_uri":          {testRedirectUri},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"code_challenge":        {testCodeVerifier},
+		"code_challenge_method": {"plain"},
+	}
+	recorder := httptest.NewRecorder()
+	authorizeHandler(recorder, httptest.NewRequest(http.MethodGet, "/authorize?"+query.Encode(), nil))
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Host != "app.example.com" || location.Query().Get("error") != "invalid_request" {
+		t.Errorf("got redirect to %s, want an invalid_request error", location)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Outbound HTTP configuration shared by the calls to Azure AD, Graph and the downstream APIs. Every call is
+// bounded by the timeout of its operation and by the context of the inbound request that caused it.
+
+var (
+	// default for the operations without their own timeout
+	timeout = getenvDuration("HTTP_TIMEOUT", 5*time.Second)
+
+	tokenTimeout      = getenvDuration("HTTP_TOKEN_TIMEOUT", timeout)
+	graphTimeout      = getenvDuration("HTTP_GRAPH_TIMEOUT", timeout)
+	downstreamTimeout = getenvDuration("HTTP_DOWNSTREAM_TIMEOUT", 30*time.Second)
+
+	outboundTransport = newOutboundTransport(
+		getenvDefault("HTTP_PROXY_URL", ""),
+		getenvDefault("HTTP_CA_FILE", ""),
+		getenvDefault("HTTP_CLIENT_CERTIFICATE_FILE", ""),
+		getenvDefault("HTTP_CLIENT_KEY_FILE", ""),
+	)
+
+	client = http.Client{
+		Transport: requestIDTransport{retryTransport{tracingTransport{outboundTransport}}},
+	}
+)
+
+// newOutboundTransport uses the proxy given, or HTTPS_PROXY and NO_PROXY, trusts the CA certificates in caFile
+// on top of the system ones and presents the client certificate to servers that ask for one
+func newOutboundTransport(proxyUrl, caFile, certFile, keyFile string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxyUrl != "" {
+		u, err := url.Parse(proxyUrl)
+		if err != nil || u.Host == "" {
+			panic("Invalid proxy URL in HTTP_PROXY_URL")
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		tlsConfig.RootCAs = loadCertPool(caFile)
+	}
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			panic(fmt.Errorf("ERROR: can not load outbound client certificate: %s", err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return transport
+}
+
+// loadCertPool returns the system CA certificates with the ones in the PEM file added
+func loadCertPool(caFile string) *x509.CertPool {
+	pem, err := ioutil.ReadFile(caFile)
+	handleError(err)
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		panic(fmt.Errorf("ERROR: no CA certificates found in %s", caFile))
+	}
+	return pool
+}
+
+// cancelOnClose releases the timeout of a call once the caller is done reading the response body
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// doWithTimeout sends the request bounded by the operation timeout, the timeout lasts until the body is closed
+func doWithTimeout(request *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	response.Body = cancelOnClose{response.Body, cancel}
+	return response, nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Brute-force protection for the endpoints that look up tokens and client secrets: token buckets per
+// client IP and per presented token, and lockout of IPs that keep presenting unknown credentials.
+// Guessing is held back by the IP bucket and the lockout, the token bucket limits the attempts with one
+// temporary token, code or refresh token. Routes called with a valid session token many times a minute
+// use rateLimitIP, without the token bucket.
+
+const (
+	maxLockout = time.Hour
+	// the in-memory store drops idle buckets once it holds this many
+	rateLimitMaxEntries = 10000
+
+	rateLimitRedisPrefix = "azure_auth:ratelimit:"
+)
+
+var (
+	ipRate          = parseRate("RATE_LIMIT_IP", getenvDefault("RATE_LIMIT_IP", "60/m"))
+	tokenRate       = parseRate("RATE_LIMIT_TOKEN", getenvDefault("RATE_LIMIT_TOKEN", "10/m"))
+	maxFailures     = getenvInt("RATE_LIMIT_MAX_FAILURES", 10)
+	lockoutDuration = getenvDuration("RATE_LIMIT_LOCKOUT", time.Minute)
+	// on Heroku, where DYNO is set, every request comes from the router
+	trustProxy = getenvDefault("RATE_LIMIT_TRUST_PROXY", fmt.Sprint(getenvDefault("DYNO", "") != "")) == "true"
+
+	rateLimits = newRateLimitStore(getenvDefault("RATE_LIMIT_REDIS_URL", ""), newRedisTLSConfig(
+		getenvDefault("RATE_LIMIT_REDIS_CA_FILE", ""),
+		getenvDefault("RATE_LIMIT_REDIS_INSECURE_SKIP_VERIFY", "") == "true",
+	))
+
+	// credentials read from the form when the Authorization header is not set
+	rateLimitTokenParams = []string{"temporary_token", "public_token", "code", "refresh_token", "device_code", "assertion"}
+)
+
+// Rate allows Limit requests per Period, in bursts of up to Limit; a zero Limit disables it
+type Rate struct {
+	Limit  int
+	Period time.Duration
+}
+
+// parseRate reads values such as "60/m", "5/s" or "off"
+func parseRate(name, value string) Rate {
+	if value == "off" || value == "0" {
+		return Rate{}
+	}
+
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	parts := strings.SplitN(value, "/", 2)
+	limit, err := strconv.Atoi(parts[0])
+	if len(parts) != 2 || err != nil || limit < 0 || periods[parts[1]] == 0 {
+		panic("Invalid rate in environment variable " + name)
+	}
+	return Rate{Limit: limit, Period: periods[parts[1]]}
+}
+
+// RateLimitStore keeps the buckets and failure counts, in memory or in Redis when several instances share them
+type RateLimitStore interface {
+	// Take removes a token from the bucket at key and returns how long to wait when it is empty
+	Take(key string, rate Rate) (time.Duration, error)
+	// Fail counts a failed lookup at key and returns the lockout once there were too many
+	Fail(key string) (time.Duration, error)
+	// LockedFor returns the remaining lockout at key
+	LockedFor(key string) (time.Duration, error)
+}
+
+func newRateLimitStore(redisUrl string, tlsConfig *tls.Config) RateLimitStore {
+	if redisUrl == "" {
+		return &memoryRateLimitStore{buckets: map[string]*rateBucket{}, failures: map[string]*failureCount{}}
+	}
+
+	redis, err := NewRedisClient(redisUrl, tlsConfig)
+	if err != nil {
+		panic(fmt.Errorf("ERROR: invalid RATE_LIMIT_REDIS_URL: %s", err))
+	}
+	return &redisRateLimitStore{redis: redis}
+}
+
+// lockoutFor doubles the lockout with every failure past maxFailures, up to maxLockout
+func lockoutFor(failures int) time.Duration {
+	if maxFailures <= 0 || failures < maxFailures {
+		return 0
+	}
+	lockout := float64(lockoutDuration) * math.Pow(2, float64(failures-maxFailures))
+	if lockout > float64(maxLockout) {
+		return maxLockout
+	}
+	return time.Duration(lockout)
+}
+
+type rateBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+type failureCount struct {
+	count       int
+	lastAt      time.Time
+	lockedUntil time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*rateBucket
+	failures map[string]*failureCount
+}
+
+func (s *memoryRateLimitStore) Take(key string, rate Rate) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if len(s.buckets) >= rateLimitMaxEntries {
+		for k, b := range s.buckets {
+			if now.Sub(b.updatedAt) > rate.Period {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: float64(rate.Limit), updatedAt: now}
+		s.buckets[key] = b
+	}
+	perToken := float64(rate.Period) / float64(rate.Limit)
+	b.tokens = math.Min(float64(rate.Limit), b.tokens+float64(now.Sub(b.updatedAt))/perToken)
+	b.updatedAt = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * perToken), nil
+	}
+	b.tokens--
+	return 0, nil
+}
+
+func (s *memoryRateLimitStore) Fail(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if len(s.failures) >= rateLimitMaxEntries {
+		for k, f := range s.failures {
+			if now.Sub(f.lastAt) > maxLockout {
+				delete(s.failures, k)
+			}
+		}
+	}
+
+	f, ok := s.failures[key]
+	if !ok || now.Sub(f.lastAt) > maxLockout {
+		f = &failureCount{}
+		s.failures[key] = f
+	}
+	f.count++
+	f.lastAt = now
+
+	lockout := lockoutFor(f.count)
+	if lockout > 0 {
+		f.lockedUntil = now.Add(lockout)
+	}
+	return lockout, nil
+}
+
+func (s *memoryRateLimitStore) LockedFor(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.failures[key]; ok {
+		if wait := time.Until(f.lockedUntil); wait > 0 {
+			return wait, nil
+		}
+	}
+	return 0, nil
+}
+
+// takeScript refills the bucket for the time passed since the last request, all times in milliseconds
+const takeScript = `
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or limit
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(limit, tokens + math.max(0, now - ts) * limit / period)
+local wait = 0
+if tokens < 1 then
+  wait = math.ceil((1 - tokens) * period / limit)
+else
+  tokens = tokens - 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], period)
+return wait
+`
+
+const failScript = `
+local count = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return count
+`
+
+type redisRateLimitStore struct {
+	redis *RedisClient
+}
+
+func (s *redisRateLimitStore) Take(key string, rate Rate) (time.Duration, error) {
+	reply, err := s.redis.Do("EVAL", takeScript, 1, rateLimitRedisPrefix+"bucket:"+key,
+		rate.Limit, milliseconds(rate.Period), time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	wait, _ := reply.(int64)
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+func (s *redisRateLimitStore) Fail(key string) (time.Duration, error) {
+	reply, err := s.redis.Do("EVAL", failScript, 1, rateLimitRedisPrefix+"failures:"+key, milliseconds(maxLockout))
+	if err != nil {
+		return 0, err
+	}
+	count, _ := reply.(int64)
+
+	lockout := lockoutFor(int(count))
+	if lockout > 0 {
+		_, err = s.redis.Do("SET", rateLimitRedisPrefix+"lock:"+key, 1, "PX", milliseconds(lockout))
+	}
+	return lockout, err
+}
+
+func (s *redisRateLimitStore) LockedFor(key string) (time.Duration, error) {
+	reply, err := s.redis.Do("PTTL", rateLimitRedisPrefix+"lock:"+key)
+	if err != nil {
+		return 0, err
+	}
+	ttl, _ := reply.(int64)
+	if ttl <= 0 {
+		return 0, nil
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+type lookupFailuresKey struct{}
+
+// failedLookup is called where an unknown token or client secret is presented, so that rateLimit can count it
+func failedLookup(ctx context.Context) {
+	if failures, ok := ctx.Value(lookupFailuresKey{}).(*int32); ok {
+		atomic.AddInt32(failures, 1)
+	}
+}
+
+// clientIP is the peer address or, with RATE_LIMIT_TRUST_PROXY behind a load balancer such as Heroku's router,
+// the address the proxy appended to X-Forwarded-For. Without it every client behind the proxy would share
+// one bucket and one lockout.
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// presentedToken is the credential the request is trying, the form is only read without an Authorization header
+// so that the body of proxied requests is left alone
+func presentedToken(r *http.Request) string {
+	if token := r.Header.Get("Authorization"); token != "" {
+		// client secrets in basic auth are covered by the IP bucket and the lockout, a bucket per client
+		// would throttle busy confidential clients
+		if strings.HasPrefix(token, "Basic ") {
+			return ""
+		}
+		return bearerToken(token)
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	for _, name := range rateLimitTokenParams {
+		if token := r.FormValue(name); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// rateLimit is the middleware for the routes exchanging one-time credentials. Store errors are
+// logged and let the request through, an unavailable Redis must not take the login down.
+func rateLimit(next http.Handler) http.Handler {
+	return rateLimiter(next, true)
+}
+
+// rateLimitIP is rateLimit without the token bucket, for the routes authenticated with session and access tokens
+func rateLimitIP(next http.Handler) http.Handler {
+	return rateLimiter(next, false)
+}
+
+func rateLimiter(next http.Handler, perToken bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := loggerFromContext(r.Context())
+		ipKey := fmt.Sprint("ip:", clientIP(r))
+
+		allowed := func(reason string, wait time.Duration, err error) bool {
+			if err != nil {
+				log.Warn("Rate limit store failed", "error", err)
+				return true
+			}
+			if wait <= 0 {
+				return true
+			}
+			rateLimitedTotal.Inc(reason)
+			log.Warn("Rate limited", "reason", reason, "ip", clientIP(r), "retry_after", wait.String())
+			w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return false
+		}
+
+		wait, err := rateLimits.LockedFor(ipKey)
+		if !allowed("lockout", wait, err) {
+			return
+		}
+		if ipRate.Limit > 0 {
+			wait, err = rateLimits.Take(ipKey, ipRate)
+			if !allowed("ip", wait, err) {
+				return
+			}
+		}
+		// keyed on the hash of the whole token, JWTs and other tokens share their first characters
+		if token := presentedToken(r); perToken && token != "" && tokenRate.Limit > 0 {
+			wait, err = rateLimits.Take(fmt.Sprint("token:", hashToken(token)), tokenRate)
+			if !allowed("token", wait, err) {
+				return
+			}
+		}
+
+		failures := new(int32)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), lookupFailuresKey{}, failures)))
+
+		if atomic.LoadInt32(failures) == 0 {
+			return
+		}
+		lockout, err := rateLimits.Fail(ipKey)
+		if err != nil {
+			log.Warn("Rate limit store failed", "error", err)
+		} else if lockout > 0 {
+			log.Warn("Locked out after repeated failed lookups", "ip", clientIP(r), "lockout", lockout.String())
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*rateBucket{}, failures: map[string]*failureCount{}}
+}
+
+// withRateLimits runs the test with an empty in-memory store and the limits given
+func withRateLimits(t *testing.T, ip, token Rate, failures int, lockout time.Duration) *memoryRateLimitStore {
+	store := newMemoryRateLimitStore()
+	previousStore, previousIp, previousToken := rateLimits, ipRate, tokenRate
+	previousFailures, previousLockout := maxFailures, lockoutDuration
+	rateLimits, ipRate, tokenRate, maxFailures, lockoutDuration = store, ip, token, failures, lockout
+	t.Cleanup(func() {
+		rateLimits, ipRate, tokenRate = previousStore, previousIp, previousToken
+		maxFailures, lockoutDuration = previousFailures, previousLockout
+	})
+	return store
+}
+
+func TestMemoryRateLimitStoreRefills(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	rate := Rate{Limit: 2, Period: time.Minute}
+
+	for i := 0; i < rate.Limit; i++ {
+		if wait, _ := store.Take("key", rate); wait != 0 {
+			t.Fatalf("request %d waits %s within the burst", i+1, wait)
+		}
+	}
+	wait, _ := store.Take("key", rate)
+	if wait <= 0 || wait > 30*time.Second {
+		t.Fatalf("empty bucket waits %s, want up to 30s", wait)
+	}
+
+	// half the period refills one token
+	store.buckets["key"].updatedAt = store.buckets["key"].updatedAt.Add(-30 * time.Second)
+	if wait, _ := store.Take("key", rate); wait != 0 {
+		t.Errorf("refilled bucket waits %s", wait)
+	}
+	if wait, _ := store.Take("key", rate); wait == 0 {
+		t.Error("bucket refilled more than one token")
+	}
+}
+
+func TestLockoutDoubles(t *testing.T) {
+	withRateLimits(t, Rate{}, Rate{}, 3, time.Minute)
+
+	for failures, want := range map[int]time.Duration{
+		2: 0, 3: time.Minute, 4: 2 * time.Minute, 5: 4 * time.Minute, 9: maxLockout, 100: maxLockout,
+	} {
+		if got := lockoutFor(failures); got != want {
+			t.Errorf("lockoutFor(%d) = %s, want %s", failures, got, want)
+		}
+	}
+
+	store := newMemoryRateLimitStore()
+	for i := 0; i < 3; i++ {
+		store.Fail("ip")
+	}
+	if wait, _ := store.LockedFor("ip"); wait <= 0 || wait > time.Minute {
+		t.Errorf("locked for %s after 3 failures, want up to 1m", wait)
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	withRateLimits(t, Rate{Limit: 1, Period: time.Minute}, Rate{}, 0, time.Minute)
+	handler := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/get_me", nil))
+		return recorder
+	}
+	if response := serve(); response.Code != http.StatusOK {
+		t.Fatalf("first request got %d", response.Code)
+	}
+	response := serve()
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != "60" {
+		t.Errorf("got %d with Retry-After %q, want 429 with 60", response.Code, response.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitLocksOutAfterFailedLookups(t *testing.T) {
+	withRateLimits(t, Rate{}, Rate{}, 2, time.Minute)
+	handler := rateLimitIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failedLookup(r.Context())
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/get_me", nil))
+		codes = append(codes, recorder.Code)
+	}
+	if codes[0] != http.StatusUnauthorized || codes[1] != http.StatusUnauthorized || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("got %v, want the third request locked out", codes)
+	}
+}
+
+func TestRateLimitTokenBucketOnlyForOneTimeCredentials(t *testing.T) {
+	withRateLimits(t, Rate{}, Rate{Limit: 1, Period: time.Minute}, 0, time.Minute)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for name, handler := range map[string]http.Handler{"rateLimit": rateLimit(ok), "rateLimitIP": rateLimitIP(ok)} {
+		codes := []int{}
+		for i := 0; i < 2; i++ {
+			request := httptest.NewRequest(http.MethodGet, "/get_me", nil)
+			request.Header.Set("Authorization", "Bearer "+name)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			codes = append(codes, recorder.Code)
+		}
+		limited := codes[1] == http.StatusTooManyRequests
+		if limited != (name == "rateLimit") {
+			t.Errorf("%s: got %v", name, codes)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(previous bool) { trustProxy = previous }(trustProxy)
+	request := httptest.NewRequest(http.MethodGet, "/get_me", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.7")
+
+	trustProxy = false
+	if ip := clientIP(request); ip != "10.0.0.1" {
+		t.Errorf("got %s without RATE_LIMIT_TRUST_PROXY, want the peer address", ip)
+	}
+	trustProxy = true
+	if ip := clientIP(request); ip != "203.0.113.7" {
+		t.Errorf("got %s, want the address the proxy appended", ip)
+	}
+}
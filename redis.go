@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal RESP client for Redis, enough for the rate limiter: a pool of connections, each running
+// one command at a time
+
+const (
+	redisTimeout = 2 * time.Second
+	// connections open at once, requests wait up to redisTimeout for one beyond that
+	redisPoolSize = 10
+)
+
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+type RedisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	// nil without TLS
+	tlsConfig *tls.Config
+
+	// idle connections, and a slot for every connection in use or idle
+	idle  chan *redisConn
+	slots chan struct{}
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisClient parses redis://[[user]:password@]host:port[/db], or rediss:// for TLS with tlsConfig,
+// without connecting yet
+func NewRedisClient(rawurl string, tlsConfig *tls.Config) (*RedisClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" || u.Host == "" {
+		return nil, errors.New("redis URL must start with redis:// or rediss://")
+	}
+
+	c := &RedisClient{
+		addr:  u.Host,
+		idle:  make(chan *redisConn, redisPoolSize),
+		slots: make(chan struct{}, redisPoolSize),
+	}
+	if u.Scheme == "rediss" {
+		c.tlsConfig = tlsConfig
+		if c.tlsConfig == nil {
+			c.tlsConfig = &tls.Config{}
+		}
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, errors.New("redis database must be a number")
+		}
+	}
+	return c, nil
+}
+
+// newRedisTLSConfig trusts the CA certificates in caFile on top of the system ones. Heroku Redis serves a
+// self-signed certificate, it needs insecureSkipVerify.
+func newRedisTLSConfig(caFile string, insecureSkipVerify bool) *tls.Config {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		tlsConfig.RootCAs = loadCertPool(caFile)
+	}
+	return tlsConfig
+}
+
+// Do sends a command on a pooled connection and returns its reply as a string, int64, []byte, []interface{} or nil
+func (c *RedisClient) Do(args ...interface{}) (interface{}, error) {
+	timeout := time.NewTimer(redisTimeout)
+	defer timeout.Stop()
+	select {
+	case c.slots <- struct{}{}:
+	case <-timeout.C:
+		return nil, errors.New("no redis connection available")
+	}
+	defer func() { <-c.slots }()
+
+	var conn *redisConn
+	select {
+	case conn = <-c.idle:
+	default:
+		var err error
+		if conn, err = c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := conn.roundTrip(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// the connection is in an unknown state after a network error
+		conn.conn.Close()
+		return reply, err
+	}
+	c.idle <- conn
+	return reply, err
+}
+
+func (c *RedisClient) connect() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if c.password != "" {
+		// Redis 6 ACL users authenticate with AUTH user password, the default user with just the password
+		auth := []interface{}{"AUTH", c.password}
+		if c.username != "" {
+			auth = []interface{}{"AUTH", c.username, c.password}
+		}
+		if _, err := rc.roundTrip(auth); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.roundTrip([]interface{}{"SELECT", c.db}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (c *redisConn) roundTrip(args []interface{}) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		s := fmt.Sprint(arg)
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(s), s)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.readReply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers +OK to every command and records them
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, tlsConfig *tls.Config) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	server := &fakeRedis{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	for {
+		reply, err := rc.readReply()
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+		s.mu.Unlock()
+		io.WriteString(conn, "+OK\r\n")
+	}
+}
+
+func (s *fakeRedis) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func TestRedisClientAuthenticates(t *testing.T) {
+	tests := map[string]string{
+		"redis://:secret@%s/2":      "AUTH secret,SELECT 2,PING",
+		"redis://user:secret@%s":    "AUTH user secret,PING",
+		"redis://%s":                "PING",
+		"redis://default:secret@%s": "AUTH default secret,PING",
+	}
+	for rawurl, want := range tests {
+		server := newFakeRedis(t, nil)
+		client, err := NewRedisClient(fmt.Sprintf(rawurl, server.listener.Addr()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Do("PING"); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(server.Commands(), ","); got != want {
+			t.Errorf("%s: sent %q, want %q", rawurl, got, want)
+		}
+	}
+}
+
+func TestRedisClientTLS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "redis"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeRedis(t, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	rawurl := fmt.Sprint("rediss://:secret@", server.listener.Addr())
+
+	verifying, _ := NewRedisClient(rawurl, newRedisTLSConfig("", false))
+	if _, err := verifying.Do("PING"); err == nil {
+		t.Error("self-signed certificate was accepted")
+	}
+
+	insecure, _ := NewRedisClient(rawurl, newRedisTLSConfig("", true))
+	if _, err := insecure.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(server.Commands(), ","); got != "AUTH secret,PING" {
+		t.Errorf("sent %q", got)
+	}
+}
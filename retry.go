@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Retries for throttled and transiently failing Azure AD and Graph calls, and a circuit breaker per host
+// so that requests fail fast with 503 while one of them is down. The downstream APIs are retried as well,
+// but do not trip a breaker: one failing API must not look like an Azure AD outage.
+
+const (
+	retryBaseDelay = 200 * time.Millisecond
+	// hint sent to our clients when Azure AD or Graph gave none
+	defaultRetryAfter = 5 * time.Second
+	drainLimit        = 4096
+)
+
+var (
+	maxRetries      = getenvInt("HTTP_MAX_RETRIES", 3)
+	maxRetryWait    = getenvDuration("HTTP_MAX_RETRY_WAIT", 10*time.Second)
+	breakerFailures = getenvInt("CIRCUIT_BREAKER_FAILURES", 5)
+	breakerCooldown = getenvDuration("CIRCUIT_BREAKER_COOLDOWN", 30*time.Second)
+
+	breakers = &circuitBreakers{hosts: map[string]*circuitBreaker{}}
+	// the hosts behind the breakers, Azure AD and Graph
+	breakerHosts = map[string]bool{
+		authority.Host:                          true,
+		hostOf(xOauth2Config.Endpoint.TokenURL): true,
+		hostOf(graphResource):                   true,
+	}
+)
+
+// UnavailableError means Azure AD or Graph is throttling us or down, RetryAfter is passed on to our clients
+type UnavailableError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s is unavailable, retry after %s", e.Host, e.RetryAfter)
+}
+
+// unavailable reports whether a failed call means Azure AD or Graph is throttling us or down, and when to retry
+func unavailable(response *http.Response, err error) (time.Duration, bool) {
+	switch e := err.(type) {
+	case nil:
+	case *UnavailableError:
+		return e.RetryAfter, true
+	case *oauth2.RetrieveError:
+		response = e.Response
+	case *url.Error:
+		// client.Do wraps the transport errors, an open circuit included
+		if open, ok := e.Err.(*UnavailableError); ok {
+			return open.RetryAfter, true
+		}
+		return defaultRetryAfter, true
+	case net.Error:
+		return defaultRetryAfter, true
+	default:
+		return 0, false
+	}
+
+	if response == nil {
+		return 0, false
+	}
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if wait := retryAfter(response); wait > 0 {
+			return wait, true
+		}
+		return defaultRetryAfter, true
+	}
+	return 0, false
+}
+
+// upstreamUnavailable answers 503 when a call failed because Azure AD or Graph is throttling us or down,
+// closing the response, and reports whether it did
+func upstreamUnavailable(w http.ResponseWriter, r *http.Request, response *http.Response, err error) bool {
+	wait, ok := unavailable(response, err)
+	if !ok {
+		return false
+	}
+	if response != nil {
+		response.Body.Close()
+	}
+
+	status := 0
+	if response != nil {
+		status = response.StatusCode
+	}
+	loggerFromContext(r.Context()).Warn("Upstream unavailable", "status", status, "error", err, "retry_after", wait.String())
+	serviceUnavailable(w, wait)
+	return true
+}
+
+// serviceUnavailable answers with a clean 503 and a retry hint instead of failing the request
+func serviceUnavailable(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64(wait / time.Second)
+	if wait%time.Second != 0 {
+		seconds++
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	http.Error(w, "Azure AD or Microsoft Graph is unavailable, try again later", http.StatusServiceUnavailable)
+}
+
+// retryAfter reads the Retry-After header, in seconds or as an HTTP date
+func retryAfter(response *http.Response) time.Duration {
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	handleError(err)
+	return u.Host
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// backoff is exponential with jitter, between half and the full delay for the attempt
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryTransport retries requests throttled with 429, which Azure AD and Graph did not process, and for
+// idempotent requests also network errors and 502, 503 and 504, waiting as long as Retry-After asks
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Host
+	guarded := breakerHosts[host]
+	probe := false
+	if guarded {
+		var err error
+		if probe, err = breakers.Allow(host); err != nil {
+			return nil, err
+		}
+	}
+	// a probe that ends without an outcome, canceled or failing before reaching the host,
+	// hands the probe over to the next request instead of keeping the circuit open for good
+	recorded := false
+	defer func() {
+		if probe && !recorded {
+			breakers.Release(host)
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		outbound := r
+		if attempt > 0 && r.Body != nil && r.Body != http.NoBody {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			outbound = r.Clone(r.Context())
+			outbound.Body = body
+		}
+
+		response, err := t.base.RoundTrip(outbound)
+		wait, retry := t.shouldRetry(r, response, err, attempt)
+		if !retry {
+			// a canceled inbound request says nothing about the upstream health
+			if guarded && r.Context().Err() == nil {
+				breakers.Record(host, err != nil || response.StatusCode >= 500)
+				recorded = true
+			}
+			return response, err
+		}
+
+		if response != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(response.Body, drainLimit))
+			response.Body.Close()
+		}
+		httpRetriesTotal.Inc(host)
+		loggerFromContext(r.Context()).Debug("Retrying outbound request", "host", host, "attempt", attempt+1, "wait", wait.String())
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (t retryTransport) shouldRetry(r *http.Request, response *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= maxRetries || r.Context().Err() != nil {
+		return 0, false
+	}
+	if r.Body != nil && r.Body != http.NoBody && r.GetBody == nil {
+		return 0, false
+	}
+
+	var wait time.Duration
+	switch {
+	case err != nil:
+		if !idempotent(r.Method) {
+			return 0, false
+		}
+		wait = backoff(attempt)
+	case response.StatusCode == http.StatusTooManyRequests:
+		wait = retryAfter(response)
+	case response.StatusCode == http.StatusBadGateway || response.StatusCode == http.StatusServiceUnavailable ||
+		response.StatusCode == http.StatusGatewayTimeout:
+		if !idempotent(r.Method) {
+			return 0, false
+		}
+		wait = retryAfter(response)
+	default:
+		return 0, false
+	}
+	if wait <= 0 {
+		wait = backoff(attempt)
+	}
+
+	// waiting longer than the caller can is pointless, the response is passed on with its Retry-After instead
+	if wait > maxRetryWait {
+		return 0, false
+	}
+	if deadline, ok := r.Context().Deadline(); ok && time.Until(deadline) < wait {
+		return 0, false
+	}
+	return wait, true
+}
+
+// circuitBreaker opens after breakerFailures consecutive failures, and after breakerCooldown
+// lets a single request through to probe whether the host is back
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+type circuitBreakers struct {
+	mu    sync.Mutex
+	hosts map[string]*circuitBreaker
+}
+
+// Allow fails while the circuit of the host is open, probe is true for the single request let through
+// after the cooldown, which must end with Record or Release
+func (cb *circuitBreakers) Allow(host string) (probe bool, err error) {
+	if breakerFailures <= 0 {
+		return false, nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, ok := cb.hosts[host]
+	if !ok || b.openUntil.IsZero() {
+		return false, nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return false, &UnavailableError{Host: host, RetryAfter: wait}
+	}
+	if b.probing {
+		return false, &UnavailableError{Host: host, RetryAfter: defaultRetryAfter}
+	}
+	b.probing = true
+	return true, nil
+}
+
+// Release gives up the probe of a request that ended without telling whether the host is back
+func (cb *circuitBreakers) Release(host string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if b, ok := cb.hosts[host]; ok {
+		b.probing = false
+	}
+}
+
+func (cb *circuitBreakers) Record(host string, failed bool) {
+	if breakerFailures <= 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, ok := cb.hosts[host]
+	if !ok {
+		b = &circuitBreaker{}
+		cb.hosts[host] = b
+	}
+	if !failed {
+		if !b.openUntil.IsZero() {
+			logger.Info("Circuit closed", "host", host)
+		}
+		*b = circuitBreaker{}
+		return
+	}
+
+	b.failures++
+	if b.probing || b.failures >= breakerFailures {
+		b.openUntil = time.Now().Add(breakerCooldown)
+		b.probing = false
+		logger.Warn("Circuit opened", "host", host, "failures", b.failures, "cooldown", breakerCooldown.String())
+	}
+}
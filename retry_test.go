@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// openBreaker trips the breaker of the test server's host and waits for its cooldown
+func openBreaker(t *testing.T, server *httptest.Server) string {
+	host := mustHost(t, server.URL)
+	breakerHosts[host] = true
+	breakerCooldown = 10 * time.Millisecond
+	t.Cleanup(func() {
+		delete(breakerHosts, host)
+		delete(breakers.hosts, host)
+		breakerCooldown = 30 * time.Second
+	})
+
+	for i := 0; i < breakerFailures; i++ {
+		breakers.Record(host, true)
+	}
+	if _, err := breakers.Allow(host); err == nil {
+		t.Fatal("breaker did not open")
+	}
+	time.Sleep(2 * breakerCooldown)
+	return host
+}
+
+func mustHost(t *testing.T, rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+func TestRetryTransportReleasesCanceledProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	host := openBreaker(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	if _, err := (retryTransport{http.DefaultTransport}).RoundTrip(request.WithContext(ctx)); err == nil {
+		t.Fatal("canceled request succeeded")
+	}
+
+	probe, err := breakers.Allow(host)
+	if err != nil || !probe {
+		t.Fatalf("next request is not let through as the probe: %v", err)
+	}
+	breakers.Release(host)
+}
+
+func TestRetryTransportClosesCircuitAfterProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	host := openBreaker(t, server)
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	response, err := (retryTransport{http.DefaultTransport}).RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if probe, err := breakers.Allow(host); err != nil || probe {
+		t.Fatalf("circuit is still open after a successful probe: %v", err)
+	}
+}
+
+func TestRetryTransportWithoutBreakerForOtherHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	for i := 0; i < breakerFailures+1; i++ {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		response, err := (retryTransport{http.DefaultTransport}).RoundTrip(request)
+		if err != nil {
+			t.Fatalf("request %d failed: %v", i+1, err)
+		}
+		response.Body.Close()
+	}
+	if _, ok := breakers.hosts[mustHost(t, server.URL)]; ok {
+		t.Error("failures of a host other than Azure AD and Graph were recorded")
+	}
+}
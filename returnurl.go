@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ReturnURLAllowlist holds the destinations /auth may send the temporary token to.
+// Entries are exact URLs ("https://app.example.com/callback"), prefixes ending with "*"
+// ("https://app.example.com/*") or custom scheme URLs ("myapp://callback", "myapp://*").
+var ReturnURLAllowlist = parseReturnURLAllowlist(getenvDefault("RETURN_URL_ALLOWLIST", ""))
+
+type returnURLRule struct {
+	value  string
+	prefix bool
+}
+
+func parseReturnURLAllowlist(list string) []returnURLRule {
+	rules := []returnURLRule{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix := strings.HasSuffix(entry, "*")
+		entry = strings.TrimSuffix(entry, "*")
+		normalized, err := normalizeReturnURL(entry)
+		if err != nil {
+			panic("Invalid entry in RETURN_URL_ALLOWLIST: " + entry)
+		}
+		rules = append(rules, returnURLRule{value: normalized, prefix: prefix})
+	}
+	return rules
+}
+
+// normalizeReturnURL lowercases scheme and host so that the allowlist comparison is not case sensitive there
+func normalizeReturnURL(raw string) (string, error) {
+	if strings.ContainsAny(raw, "\\\r\n\t ") {
+		return "", errors.New("return URL contains invalid characters")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Opaque != "" || u.User != nil {
+		return "", errors.New("return URL must be absolute")
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host == "" {
+		return "", errors.New("return URL must have a host")
+	}
+	if strings.EqualFold(u.Scheme, "javascript") || strings.EqualFold(u.Scheme, "data") {
+		return "", errors.New("return URL scheme is not allowed")
+	}
+	// the browser resolves "/app/../other" to "/other", outside of a "/app/*" rule. u.Path has
+	// "%2e%2e" decoded as well.
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return "", errors.New("return URL path contains dot segments")
+		}
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String(), nil
+}
+
+// resolveReturnURL validates a return_to value against RETURN_URL_ALLOWLIST and the redirect URIs
+// registered for the client, falling back to BASE_URL when it is empty
+func resolveReturnURL(c Client, returnTo string) (string, error) {
+	if returnTo == "" {
+		return BaseUrl, nil
+	}
+
+	normalized, err := normalizeReturnURL(returnTo)
+	if err != nil {
+		return "", err
+	}
+	if base, _ := normalizeReturnURL(BaseUrl); normalized == base {
+		return normalized, nil
+	}
+
+	for _, rule := range append(c.redirectRules(), ReturnURLAllowlist...) {
+		if rule.matches(normalized) {
+			return normalized, nil
+		}
+	}
+	return "", errors.New("return URL is not allowed")
+}
+
+func (rule returnURLRule) matches(target string) bool {
+	if !rule.prefix {
+		return target == rule.value
+	}
+	if !strings.HasPrefix(target, rule.value) {
+		return false
+	}
+
+	// "https://app.example.com*" must not match "https://app.example.com.evil.net"
+	if len(target) == len(rule.value) || strings.HasSuffix(rule.value, "/") {
+		return true
+	}
+	return strings.ContainsAny(target[len(rule.value):len(rule.value)+1], "/?#")
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestResolveReturnURL(t *testing.T) {
+	defer func(allowlist []returnURLRule) { ReturnURLAllowlist = allowlist }(ReturnURLAllowlist)
+	ReturnURLAllowlist = parseReturnURLAllowlist("https://app.example.com/app/*, https://host.example.com*, myapp://callback")
+	c := Client{RedirectUris: "https://client.example.com/callback"}
+
+	tests := []struct {
+		returnTo string
+		want     string
+	}{
+		{"", BaseUrl},
+		{"https://client.example.com/callback", "https://client.example.com/callback"},
+		{"https://CLIENT.example.com/callback", "https://client.example.com/callback"},
+		{"https://client.example.com/callback/other", ""},
+		{"https://app.example.com/app/page?x=1", "https://app.example.com/app/page?x=1"},
+		{"https://app.example.com/other", ""},
+		{"https://host.example.com/page", "https://host.example.com/page"},
+		{"https://host.example.com.evil.net/page", ""},
+		{"https://host.example.com@evil.net/page", ""},
+		{"https://app.example.com/app/../other", ""},
+		{"https://app.example.com/app/%2e%2e/other", ""},
+		{"https://app.example.com/app/%2E%2E%2Fother", ""},
+		{"https://app.example.com/app/./page", ""},
+		{"myapp://callback", "myapp://callback"},
+		{"myapp://other", ""},
+		{"javascript:alert(1)", ""},
+		{"JavaScript://app.example.com/app/%0aalert(1)", ""},
+		{"/app/page", ""},
+		{"https://app.example.com\\@evil.net/app/", ""},
+	}
+	for _, test := range tests {
+		got, err := resolveReturnURL(c, test.returnTo)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("resolveReturnURL(%q) = %q, want an error", test.returnTo, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("resolveReturnURL(%q) = %q, %v, want %q", test.returnTo, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// Small router on net/http: paths are matched segment by segment, ":name" matches one segment
+// and a trailing "*" the rest of the path. HEAD requests are served by GET routes.
+
+// Middleware wraps a handler, for the whole server or single routes
+type Middleware func(http.Handler) http.Handler
+
+type route struct {
+	method   string
+	segments []string
+	handler  http.Handler
+}
+
+type Router struct {
+	routes []route
+}
+
+type routeParamsKey struct{}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers the handler for the method, "*" for any, wrapped in the middleware given in order
+func (router *Router) Handle(method, pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.routes = append(router.routes, route{
+		method:   method,
+		segments: strings.Split(strings.Trim(pattern, "/"), "/"),
+		handler:  chain(handler, middleware...),
+	})
+}
+
+func (router *Router) Get(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.Handle("GET", pattern, handler, middleware...)
+}
+
+func (router *Router) Post(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.Handle("POST", pattern, handler, middleware...)
+}
+
+func (router *Router) Delete(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.Handle("DELETE", pattern, handler, middleware...)
+}
+
+func (router *Router) Any(pattern string, handler http.HandlerFunc, middleware ...Middleware) {
+	router.Handle("*", pattern, handler, middleware...)
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for _, route := range router.routes {
+		if route.method != "*" && route.method != r.Method && !(route.method == "GET" && r.Method == "HEAD") {
+			continue
+		}
+		if params, ok := route.match(segments); ok {
+			if len(params) > 0 {
+				r = r.WithContext(context.WithValue(r.Context(), routeParamsKey{}, params))
+			}
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (route route) match(segments []string) (map[string]string, bool) {
+	params := map[string]string{}
+	for i, s := range route.segments {
+		if s == "*" && i == len(route.segments)-1 {
+			params["*"] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		switch {
+		case strings.HasPrefix(s, ":") && segments[i] != "":
+			params[s[1:]] = segments[i]
+		case s != segments[i]:
+			return nil, false
+		}
+	}
+	return params, len(segments) == len(route.segments)
+}
+
+// routeParam returns a ":name" segment, or "*" for the rest of the path, of the route that matched
+func routeParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(routeParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+// chain wraps the handler so that the first middleware runs first
+func chain(handler http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// responseWriter remembers the status for the logging and tracing middleware
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Status is what net/http sends, 200 when the handler wrote nothing
+func (w *responseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Flush lets the downstream proxy stream responses
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("hijacking is not supported")
+}
+
+// statusWriter wraps w once, so that every middleware sees the same status
+func statusWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+// recovery turns the panics handlers use for unexpected errors into a 500 and logs them with the stack
+func recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := statusWriter(w)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// the server aborts the response silently for this one
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			loggerFromContext(r.Context()).Error("PANIC", "error", err, "stack", string(debug.Stack()))
+			if rw.status == 0 {
+				http.Error(rw, "500 Internal Server Error", http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
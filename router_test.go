@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouterMatches(t *testing.T) {
+	router := NewRouter()
+	route := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + routeParam(r, "name") + " " + routeParam(r, "id") + " " + routeParam(r, "*")))
+		}
+	}
+	router.Get("/get_me", route("me"))
+	router.Post("/token", route("token"))
+	router.Post("/token/:resource", route("resource"))
+	router.Get("/admin/users/:id", route("user"))
+	router.Delete("/admin/users/:id/sessions", route("sessions"))
+	router.Any("/api/:name/*", route("api"))
+
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/get_me", "me   "},
+		{"GET", "/get_me/", "me   "},
+		{"HEAD", "/get_me", "me   "},
+		{"POST", "/get_me", "404"},
+		{"GET", "/get_me/extra", "404"},
+		{"POST", "/token", "token   "},
+		{"POST", "/token/graph", "resource   "},
+		{"GET", "/admin/users/42", "user  42 "},
+		{"GET", "/admin/users/", "404"},
+		{"GET", "/admin/users//sessions", "404"},
+		{"DELETE", "/admin/users/42/sessions", "sessions  42 "},
+		{"GET", "/admin/users/42/sessions", "404"},
+		{"PATCH", "/api/orders/v1/items/7", "api orders  v1/items/7"},
+		{"GET", "/api/orders", "api orders  "},
+		{"GET", "/api", "404"},
+		{"GET", "/unknown", "404"},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, nil))
+		got := recorder.Body.String()
+		if recorder.Code == http.StatusNotFound {
+			got = "404"
+		}
+		if got != test.want {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestChainRunsMiddlewareInOrder(t *testing.T) {
+	order := []string{}
+	middleware := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	router := NewRouter()
+	router.Get("/", func(w http.ResponseWriter, r *http.Request) { order = append(order, "handler") }, middleware("first"), middleware("second"))
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if got := strings.Join(order, ","); got != "first,second,handler" {
+		t.Errorf("ran %s", got)
+	}
+}
+
+func TestRecoveryAnswers500(t *testing.T) {
+	handler := recovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", recorder.Code)
+	}
+}
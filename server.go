@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	// HOST and PORT keep working as before, PORT is set by Heroku
+	listenAddr      = getenvDefault("LISTEN_ADDR", fmt.Sprint(getenvDefault("HOST", ""), ":", getenvDefault("PORT", "3000")))
+	shutdownTimeout = getenvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+)
+
+// serve runs the server, over HTTPS when TLS_CERT_FILE is set, until SIGTERM or SIGINT, then stops
+// accepting connections and waits up to SHUTDOWN_TIMEOUT for the requests in flight before returning
+func serve(handler http.Handler) {
+	servers := []*http.Server{{
+		Addr:              listenAddr,
+		Handler:           handler,
+		TLSConfig:         serverTLSConfig(),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}}
+	if tlsRedirectAddr != "" {
+		servers = append(servers, &http.Server{
+			Addr:              tlsRedirectAddr,
+			Handler:           httpsRedirectHandler(listenAddr),
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+	}
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if server.TLSConfig != nil {
+				logger.Info("Listening", "addr", server.Addr, "tls", true)
+				errs <- server.ListenAndServeTLS("", "")
+				return
+			}
+			logger.Info("Listening", "addr", server.Addr)
+			errs <- server.ListenAndServe()
+		}(server)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errs:
+		panic(fmt.Errorf("ERROR: %s", err))
+	case sig := <-signals:
+		logger.Info("Shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("Requests still in flight after the shutdown timeout", "addr", server.Addr, "error", err)
+			server.Close()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Session mode for browser apps: with response_mode=cookie the login ends with the public token in an
+// HttpOnly cookie instead of a temporary token for the app to exchange. Requests authenticated by the
+// cookie that change state must repeat the CSRF cookie in the X-CSRF-Token header (double submit).
+
+const (
+	responseModeCookie = "cookie"
+	csrfHeader         = "X-CSRF-Token"
+)
+
+var (
+	sessionCookieName   = getenvDefault("SESSION_COOKIE_NAME", "azure_auth_session")
+	csrfCookieName      = getenvDefault("CSRF_COOKIE_NAME", "azure_auth_csrf")
+	sessionCookieDomain = getenvDefault("SESSION_COOKIE_DOMAIN", "")
+	sessionSameSite     = parseSameSite(getenvDefault("SESSION_COOKIE_SAMESITE", "lax"))
+)
+
+func parseSameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	panic("Invalid SESSION_COOKIE_SAMESITE, use strict, lax or none: " + value)
+}
+
+// deliverSession sets the session and CSRF cookies and sends the browser on to the return URL
+func deliverSession(w http.ResponseWriter, r *http.Request, state loginState, user User) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	setSessionCookie(w, sessionCookieName, user.Session.PublicToken, true, user.Session.PublicTokenExpiresAt)
+	// readable by the app, which sends it back in the X-CSRF-Token header
+	setSessionCookie(w, csrfCookieName, newCSRFToken(), false, user.Session.PublicTokenExpiresAt)
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	handleError(err)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// setSessionCookie sets a cookie that lasts until expiresAt, for the browser session without one,
+// and deletes it for an empty value
+func setSessionCookie(w http.ResponseWriter, name, value string, httpOnly bool, expiresAt *time.Time) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   sessionCookieDomain,
+		Secure:   true,
+		HttpOnly: httpOnly,
+		SameSite: sessionSameSite,
+	}
+	switch {
+	case value == "":
+		cookie.MaxAge = -1
+	case expiresAt != nil:
+		cookie.Expires = *expiresAt
+	}
+	http.SetCookie(w, cookie)
+}
+
+// publicToken is the token in the Authorization header or, without the header, in the session cookie
+func publicToken(r *http.Request) (token string, fromCookie bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return bearerToken(header), false
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, true
+	}
+	return "", false
+}
+
+// exposeCSRFToken repeats the CSRF cookie in a response header, for apps on another site
+// which can not read the cookie of this one
+func exposeCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil {
+		w.Header().Set(csrfHeader, cookie.Value)
+	}
+}
+
+// csrfProtect rejects state-changing requests authenticated by the session cookie without the CSRF token,
+// requests with the Authorization header are not sent by browsers on their own
+func csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, fromCookie := publicToken(r); !fromCookie {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get(csrfHeader)
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil || header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+			loggerFromContext(r.Context()).Warn("CSRF token missing or invalid", "path", r.URL.Path)
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logoutHandler revokes the public token, from the header or the session cookie, and deletes the cookies
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	token, _ := publicToken(r)
+	user := FindUserByPubToken(r.Context(), token)
+	if (User{} != user) {
+		user.RevokePublicToken(r.Context())
+		auditUser(r.Context(), auditLogout, user, nil)
+		notifyWebhooks(r.Context(), webhookUserLogout, user)
+		loggerFromContext(r.Context()).Info("Signed out", "user_id", user.ID)
+	}
+
+	setSessionCookie(w, sessionCookieName, "", true, nil)
+	setSessionCookie(w, csrfCookieName, "", false, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	handler := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name          string
+		method        string
+		authorization string
+		session       bool
+		cookie        string
+		header        string
+		want          int
+	}{
+		{"safe method", "GET", "", true, "", "", http.StatusOK},
+		{"matching token", "POST", "", true, "csrf", "csrf", http.StatusOK},
+		{"missing header", "POST", "", true, "csrf", "", http.StatusForbidden},
+		{"missing cookie", "DELETE", "", true, "", "csrf", http.StatusForbidden},
+		{"both empty", "POST", "", true, "", "", http.StatusForbidden},
+		{"other token", "POST", "", true, "csrf", "other", http.StatusForbidden},
+		{"authorization header", "POST", "Bearer token", true, "", "", http.StatusOK},
+		{"no session", "POST", "", false, "", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/logout", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		if test.session {
+			request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "public-token"})
+		}
+		if test.cookie != "" {
+			request.AddCookie(&http.Cookie{Name: csrfCookieName, Value: test.cookie})
+		}
+		if test.header != "" {
+			request.Header.Set(csrfHeader, test.header)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.want)
+		}
+	}
+}
+
+func TestDeliverSessionSetsCookies(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	user := User{Session: ClientSession{PublicToken: "public-token"}}
+	deliverSession(recorder, httptest.NewRequest("GET", "/callback", nil), loginState{ReturnTo: "https://app.example.com/"}, user)
+
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range recorder.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	session, csrf := cookies[sessionCookieName], cookies[csrfCookieName]
+	if session == nil || session.Value != "public-token" || !session.HttpOnly || !session.Secure {
+		t.Errorf("session cookie %v must hold the public token, HttpOnly and Secure", session)
+	}
+	if csrf == nil || len(csrf.Value) < 32 || csrf.HttpOnly {
+		t.Errorf("CSRF cookie %v must be a random token readable by the app", csrf)
+	}
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "https://app.example.com/" {
+		t.Errorf("got %d to %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+}
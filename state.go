@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// loginState is carried through the AAD round trip in the OAuth state parameter, next to the random nonce
+type loginState struct {
+	ClientId     string `json:"client_id"`
+	ReturnTo     string `json:"return_to"`
+	ResponseMode string `json:"response_mode,omitempty"`
+	// set when the login was started by the OpenID Connect /authorize endpoint
+	Authorize *authorizeRequest `json:"authorize,omitempty"`
+	// set when the login links a device authorization started by /device/code
+	DeviceUserCode string `json:"device_user_code,omitempty"`
+}
+
+func encodeState(nonce string, s loginState) string {
+	payload, err := json.Marshal(s)
+	handleError(err)
+	return nonce + "." + base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func decodeState(state string) (s loginState, err error) {
+	parts := strings.SplitN(state, ".", 2)
+	if len(parts) != 2 {
+		return s, errors.New("malformed state")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return s, errors.New("malformed state")
+	}
+	if err = json.Unmarshal(payload, &s); err != nil {
+		return s, errors.New("malformed state")
+	}
+	return s, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Optional HTTPS serving. The certificate files are checked for changes at most every certReloadInterval
+// during handshakes, so that rotated certificates are picked up without a restart.
+
+const certReloadInterval = 10 * time.Second
+
+var (
+	tlsCertFile     = getenvDefault("TLS_CERT_FILE", "")
+	tlsKeyFile      = getenvDefault("TLS_KEY_FILE", "")
+	tlsClientCAFile = getenvDefault("TLS_CLIENT_CA_FILE", "")
+	tlsRedirectAddr = getenvDefault("TLS_REDIRECT_ADDR", "")
+	hstsMaxAge      = getenvDuration("HSTS_MAX_AGE", 365*24*time.Hour)
+	// opt-in, it forces HTTPS on every sibling subdomain of the service as well
+	hstsIncludeSubDomains = getenvDefault("HSTS_INCLUDE_SUBDOMAINS", "") == "true"
+)
+
+// certReloader serves the certificate and key files, reloading them once they are modified
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) *certReloader {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		panic(fmt.Errorf("ERROR: can not load TLS certificate: %s", err))
+	}
+	return reloader
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime, c.checkedAt = &cert, modTime, time.Now()
+	return nil
+}
+
+// GetCertificate keeps serving the previous certificate when the new files can not be loaded,
+// e.g. while the certificate has been replaced and the key not yet
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checkedAt) < certReloadInterval {
+		return c.cert, nil
+	}
+	c.checkedAt = time.Now()
+
+	modTime, err := c.latestModTime()
+	if err != nil || !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	if err := c.reload(); err != nil {
+		logger.Warn("Can not reload TLS certificate", "error", err)
+		return c.cert, nil
+	}
+	logger.Info("Reloaded TLS certificate", "file", c.certFile)
+	return c.cert, nil
+}
+
+// serverTLSConfig is nil without TLS_CERT_FILE. With TLS_CLIENT_CA_FILE client certificates are verified
+// when presented, requireClientCertificate rejects requests without one on the routes that need it.
+func serverTLSConfig() *tls.Config {
+	if tlsCertFile == "" {
+		if tlsClientCAFile != "" || tlsRedirectAddr != "" {
+			panic("TLS_CLIENT_CA_FILE and TLS_REDIRECT_ADDR require TLS_CERT_FILE")
+		}
+		return nil
+	}
+	keyFile := tlsKeyFile
+	if keyFile == "" {
+		keyFile = tlsCertFile
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: newCertReloader(tlsCertFile, keyFile).GetCertificate,
+	}
+	if tlsClientCAFile != "" {
+		pem, err := ioutil.ReadFile(tlsClientCAFile)
+		handleError(err)
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			panic(fmt.Errorf("ERROR: no CA certificates found in %s", tlsClientCAFile))
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// strictTransportSecurity tells browsers to only use HTTPS once they reached the service over it
+func strictTransportSecurity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && hstsMaxAge > 0 {
+			value := fmt.Sprintf("max-age=%d", int64(hstsMaxAge/time.Second))
+			if hstsIncludeSubDomains {
+				value += "; includeSubDomains"
+			}
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireClientCertificate guards the service-to-service routes when TLS_CLIENT_CA_FILE is set
+func requireClientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tlsClientCAFile != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirectHandler sends plain HTTP requests to the same URL on the HTTPS listener
+func httpsRedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		status := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, fmt.Sprint("https://", host, r.URL.RequestURI()), status)
+	})
+}
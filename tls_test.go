@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStrictTransportSecurity(t *testing.T) {
+	defer func(previous bool) { hstsIncludeSubDomains = previous }(hstsIncludeSubDomains)
+	handler := strictTransportSecurity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	header := func(https bool) string {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if https {
+			request.TLS = &tls.ConnectionState{}
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Header().Get("Strict-Transport-Security")
+	}
+
+	hstsIncludeSubDomains = false
+	if got := header(true); got != "max-age=31536000" {
+		t.Errorf("got %q, want max-age=31536000 without includeSubDomains", got)
+	}
+	if got := header(false); got != "" {
+		t.Errorf("got %q over plain HTTP", got)
+	}
+	hstsIncludeSubDomains = true
+	if got := header(true); got != "max-age=31536000; includeSubDomains" {
+		t.Errorf("got %q with HSTS_INCLUDE_SUBDOMAINS", got)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small OpenTelemetry-compatible tracer: W3C trace context propagation
+// and export to an OTLP/HTTP collector using the JSON encoding.
+
+type spanKind int
+
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+)
+
+type spanStatus int
+
+const (
+	spanStatusUnset spanStatus = 0
+	spanStatusOk    spanStatus = 1
+	spanStatusError spanStatus = 2
+)
+
+const (
+	traceparentHeader   = "traceparent"
+	exportBatchSize     = 512
+	exportInterval      = 5 * time.Second
+	exportQueueCapacity = 2048
+)
+
+var (
+	tracer = NewTracer(newExporterFromEnv())
+
+	traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+)
+
+type Span struct {
+	TraceID       string
+	SpanID        string
+	ParentSpanID  string
+	Name          string
+	Kind          spanKind
+	StartTime     time.Time
+	EndTime       time.Time
+	Attributes    map[string]interface{}
+	Status        spanStatus
+	StatusMessage string
+
+	sampled bool
+	remote  bool
+	tracer  *Tracer
+	mu      sync.Mutex
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	s.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed; the message goes through the log redaction rules
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Status = spanStatusError
+	s.StatusMessage = redactString(err.Error())
+	s.mu.Unlock()
+}
+
+func (s *Span) SetStatus(status spanStatus, message string) {
+	s.mu.Lock()
+	s.Status = status
+	s.StatusMessage = redactString(message)
+	s.mu.Unlock()
+}
+
+func (s *Span) End() {
+	s.mu.Lock()
+	if !s.EndTime.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	if s.sampled && !s.remote {
+		s.tracer.enqueue(s)
+	}
+}
+
+// traceparent formats the span as a W3C trace context header value
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+type spanKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// contextWithRemoteParent continues the trace described by a traceparent header
+func contextWithRemoteParent(ctx context.Context, traceparent string) context.Context {
+	m := traceparentPattern.FindStringSubmatch(strings.TrimSpace(traceparent))
+	if m == nil || m[1] == strings.Repeat("0", 32) || m[2] == strings.Repeat("0", 16) {
+		return ctx
+	}
+	flags, _ := strconv.ParseUint(m[3], 16, 8)
+
+	return context.WithValue(ctx, spanKey{}, &Span{TraceID: m[1], SpanID: m[2], sampled: flags&1 == 1, remote: true})
+}
+
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+type Tracer struct {
+	exporter SpanExporter
+	queue    chan *Span
+	done     chan struct{}
+
+	// guards queue against spans ending while Shutdown closes it
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewTracer starts a tracer exporting spans in batches; with a nil exporter spans are only propagated
+func NewTracer(exporter SpanExporter) *Tracer {
+	t := &Tracer{exporter: exporter, done: make(chan struct{})}
+	if exporter == nil {
+		close(t.done)
+		return t
+	}
+
+	t.queue = make(chan *Span, exportQueueCapacity)
+	go t.run()
+	return t
+}
+
+// Start creates a span as a child of the span carried by ctx, or as the root of a new trace
+func (t *Tracer) Start(ctx context.Context, name string, kind spanKind) (context.Context, *Span) {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: map[string]interface{}{},
+		SpanID:     randomHex(8),
+		sampled:    t.exporter != nil,
+		tracer:     t,
+	}
+
+	if parent := spanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+		span.sampled = span.sampled && parent.sampled
+	} else {
+		span.TraceID = randomHex(16)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// enqueue drops the span once the tracer is shut down
+func (t *Tracer) enqueue(span *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		logger.Warn("Trace export queue is full, dropping span", "span", span.Name)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.exporter.ExportSpans(ctx, batch); err != nil {
+			logger.Warn("Can not export spans", "count", len(batch), "error", err)
+		}
+		cancel()
+		batch = make([]*Span, 0, exportBatchSize)
+	}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Shutdown exports the spans still queued, spans ending afterwards are dropped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed && t.queue != nil {
+		close(t.queue)
+	}
+	t.closed = true
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newExporterFromEnv follows the standard OTEL_* variables; only the "otlp" exporter over http/json is supported
+func newExporterFromEnv() SpanExporter {
+	if getenvDefault("OTEL_TRACES_EXPORTER", "none") != "otlp" {
+		return nil
+	}
+
+	endpoint := getenvDefault("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if endpoint == "" {
+		endpoint = strings.TrimRight(getenvDefault("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"), "/") + "/v1/traces"
+	}
+
+	headers := map[string]string{}
+	for _, pair := range strings.Split(getenvDefault("OTEL_EXPORTER_OTLP_HEADERS", ""), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return &OTLPExporter{
+		ServiceName: getenvDefault("OTEL_SERVICE_NAME", "azure_auth"),
+		Endpoint:    endpoint,
+		Headers:     headers,
+		Client:      &http.Client{Timeout: getenvDuration("OTEL_EXPORTER_OTLP_TIMEOUT", 10*time.Second)},
+	}
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with the OTLP/HTTP JSON protocol
+type OTLPExporter struct {
+	ServiceName string
+	Endpoint    string
+	Headers     map[string]string
+	Client      *http.Client
+}
+
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(otlpPayload(e.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		request.Header.Set(k, v)
+	}
+
+	response, err := e.Client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %d", response.StatusCode)
+	}
+	return nil
+}
+
+// InMemoryExporter keeps exported spans, for tests and local debugging
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *InMemoryExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+func otlpPayload(serviceName string, spans []*Span) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := map[string]interface{}{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+			"status":            map[string]interface{}{"code": s.Status, "message": s.StatusMessage},
+		}
+		if s.ParentSpanID != "" {
+			span["parentSpanId"] = s.ParentSpanID
+		}
+		s.mu.Unlock()
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "azure_auth"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	result := make([]interface{}, 0, len(attributes))
+	for k, v := range attributes {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]interface{}{"key": k, "value": value})
+	}
+	return result
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("ERROR: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTracerExportsChildSpans(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	tr := NewTracer(exporter)
+
+	ctx, root := tr.Start(context.Background(), "root", spanKindServer)
+	_, child := tr.Start(ctx, "child", spanKindClient)
+	child.SetAttribute("http.response.status_code", "200")
+	child.End()
+	root.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	if spans[0].Name != "child" || spans[1].Name != "root" {
+		t.Fatalf("exported %q and %q, want child and root", spans[0].Name, spans[1].Name)
+	}
+	if spans[0].TraceID != root.TraceID || spans[0].ParentSpanID != root.SpanID {
+		t.Errorf("child is not in the trace of root")
+	}
+}
+
+func TestTracerDropsSpansAfterShutdown(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	tr := NewTracer(exporter)
+	_, span := tr.Start(context.Background(), "late", spanKindInternal)
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if spans := exporter.Spans(); len(spans) != 0 {
+		t.Errorf("exported %d spans ended after shutdown", len(spans))
+	}
+}
+
+func TestTracerContinuesRemoteTrace(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	tr := NewTracer(exporter)
+
+	traceId, parentId := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	request := httptest.NewRequest(http.MethodGet, "/get_me", nil)
+	ctx := contextWithRemoteParent(request.Context(), "00-"+traceId+"-"+parentId+"-01")
+	_, span := tr.Start(ctx, "GET /get_me", spanKindServer)
+	span.End()
+	tr.Shutdown(context.Background())
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, want 1", len(spans))
+	}
+	if spans[0].TraceID != traceId || spans[0].ParentSpanID != parentId {
+		t.Errorf("got trace %s parent %s, want %s %s", spans[0].TraceID, spans[0].ParentSpanID, traceId, parentId)
+	}
+}
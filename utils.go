@@ -1,9 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"net/url"
 )
 
@@ -30,13 +31,28 @@ func randToken(n int) string {
 	return string(b)
 }
 
-func generateTempTokenUrl(tempToken string) string {
-	var buf bytes.Buffer
-	buf.WriteString(BaseUrl)
-	v := url.Values{
-		"temporary_token": {tempToken},
+// generateTempTokenUrl appends the temporary token to the return URL, keeping the query it already has
+func generateTempTokenUrl(returnTo string, tempToken string) string {
+	u, err := url.Parse(returnTo)
+	handleError(err)
+
+	v := u.Query()
+	v.Set("temporary_token", tempToken)
+	u.RawQuery = v.Encode()
+	return u.String()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
-	buf.WriteString("?")
-	buf.WriteString(v.Encode())
-	return buf.String()
+	return false
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhooks notify other systems of user lifecycle events. Deliveries are stored in webhook_deliveries first
+// and sent by a background worker, retried with exponential backoff until WEBHOOK_MAX_ATTEMPTS, so that
+// events survive restarts and every attempt can be inspected.
+
+const (
+	webhookUserCreated   = "user.created"
+	webhookUserUpdated   = "user.updated"
+	webhookUserLogin     = "user.login"
+	webhookUserLogout    = "user.logout"
+	webhookRefreshFailed = "user.refresh_failed"
+	webhookUserDeleted   = "user.deleted"
+	webhookPing          = "ping"
+
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	webhookPollInterval = 5 * time.Second
+	webhookBatchSize    = 20
+	webhookRetryBase    = 10 * time.Second
+	webhookMaxRetryWait = time.Hour
+)
+
+var (
+	webhookUrls        = parseWebhookUrls(getenvDefault("WEBHOOK_URLS", ""))
+	webhookSecret      = getenvDefault("WEBHOOK_SECRET", "")
+	webhookEvents      = parseWebhookEvents(getenvDefault("WEBHOOK_EVENTS", ""))
+	webhookMaxAttempts = getenvInt("WEBHOOK_MAX_ATTEMPTS", 8)
+	webhookTimeout     = getenvDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+
+	// one request per attempt, the deliveries have their own backoff and the receivers no circuit breaker
+	webhookClient = &http.Client{Transport: outboundTransport, Timeout: webhookTimeout}
+
+	// wakes the worker up when a delivery is queued
+	webhookQueued = make(chan struct{}, 1)
+)
+
+// WebhookDelivery is one event for one URL, with the outcome of the last attempt
+type WebhookDelivery struct {
+	ID             uint       `gorm:"primary_key" json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	EventId        string     `gorm:"index" json:"event_id"`
+	Event          string     `json:"event"`
+	Url            string     `json:"url"`
+	UserId         uint       `gorm:"index" json:"user_id,omitempty"`
+	Payload        string     `json:"payload"`
+	Status         string     `gorm:"index" json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  time.Time  `gorm:"index" json:"next_attempt_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+// webhookPayload is the JSON body POSTed to the webhook URLs
+type webhookPayload struct {
+	Id        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"created_at"`
+	ClientId  string       `json:"client_id,omitempty"`
+	User      *webhookUser `json:"user,omitempty"`
+}
+
+type webhookUser struct {
+	Id      uint   `json:"id"`
+	AzureId string `json:"azure_id"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+}
+
+func parseWebhookUrls(list string) []string {
+	urls := []string{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		u, err := url.Parse(entry)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			panic("Invalid URL in WEBHOOK_URLS: " + entry)
+		}
+		urls = append(urls, entry)
+	}
+	return urls
+}
+
+// parseWebhookEvents reads the comma separated events to send, all of them when empty
+func parseWebhookEvents(list string) map[string]bool {
+	events := map[string]bool{}
+	for _, event := range strings.Split(list, ",") {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue
+		}
+		switch event {
+		case webhookUserCreated, webhookUserUpdated, webhookUserLogin, webhookUserLogout, webhookRefreshFailed, webhookUserDeleted:
+			events[event] = true
+		default:
+			panic("Unknown event in WEBHOOK_EVENTS: " + event)
+		}
+	}
+	return events
+}
+
+func webhooksEnabled() bool {
+	return len(webhookUrls) > 0
+}
+
+// notifyWebhooks queues the event about the user for every webhook URL
+func notifyWebhooks(ctx context.Context, event string, user User) {
+	if !webhooksEnabled() || (len(webhookEvents) > 0 && !webhookEvents[event]) {
+		return
+	}
+
+	payload := webhookPayload{Id: fmt.Sprint(uuid.New()), Type: event, CreatedAt: time.Now().UTC(), ClientId: user.Session.ClientId}
+	if user.ID != 0 {
+		payload.User = &webhookUser{Id: user.ID, AzureId: user.AzureId, Name: user.Name, Email: user.Email}
+	}
+	queueWebhook(ctx, payload, user.ID)
+}
+
+func queueWebhook(ctx context.Context, payload webhookPayload, userId uint) {
+	body, err := json.Marshal(payload)
+	handleError(err)
+
+	for _, u := range webhookUrls {
+		delivery := WebhookDelivery{
+			EventId:       payload.Id,
+			Event:         payload.Type,
+			Url:           u,
+			UserId:        userId,
+			Payload:       string(body),
+			Status:        deliveryPending,
+			NextAttemptAt: time.Now(),
+		}
+		if err := dbFrom(ctx).Create(&delivery).Error; err != nil {
+			loggerFromContext(ctx).Error("Can not queue webhook", "event", payload.Type, "error", err)
+		}
+	}
+	select {
+	case webhookQueued <- struct{}{}:
+	default:
+	}
+}
+
+// webhookSignature is the hex HMAC-SHA256 of "<timestamp>.<body>" with WEBHOOK_SECRET
+func webhookSignature(timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff doubles the wait after every failed attempt, up to webhookMaxRetryWait
+func webhookBackoff(attempts int) time.Duration {
+	if attempts > 16 {
+		return webhookMaxRetryWait
+	}
+	wait := webhookRetryBase << uint(attempts-1)
+	if wait > webhookMaxRetryWait {
+		return webhookMaxRetryWait
+	}
+	return wait
+}
+
+// startWebhookWorker delivers queued webhooks until the returned stop function is called. A delivery
+// interrupted by stop is sent again after the next start.
+func startWebhookWorker() (stop func()) {
+	if !webhooksEnabled() {
+		return func() {}
+	}
+	if webhookSecret == "" {
+		logger.Warn("WEBHOOK_SECRET is not set, webhook payloads are not signed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var done sync.WaitGroup
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		for {
+			deliverDueWebhooks(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-webhookQueued:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		done.Wait()
+	}
+}
+
+// deliverDueWebhooks sends the pending deliveries that are due. Each one is claimed with a conditional
+// update first, so that several instances of the service do not send it twice.
+func deliverDueWebhooks(ctx context.Context) {
+	var deliveries []WebhookDelivery
+	dbFrom(ctx).Where("status = ? AND next_attempt_at <= ?", deliveryPending, time.Now()).
+		Order("next_attempt_at").Limit(webhookBatchSize).Find(&deliveries)
+
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+		// the lease moves the next attempt past the time the worker of another instance would see
+		lease := time.Now().Add(2 * webhookTimeout)
+		claimed := dbFrom(ctx).Model(&WebhookDelivery{}).
+			Where("id = ? AND status = ? AND attempts = ? AND next_attempt_at <= ?", delivery.ID, deliveryPending, delivery.Attempts, time.Now()).
+			Update("next_attempt_at", lease)
+		if claimed.RowsAffected != 1 {
+			continue
+		}
+		deliverWebhook(ctx, &delivery)
+	}
+}
+
+func deliverWebhook(ctx context.Context, delivery *WebhookDelivery) {
+	log := logger.With("event", delivery.Event, "event_id", delivery.EventId, "url", delivery.Url)
+
+	statusCode, err := postWebhook(ctx, delivery)
+	if ctx.Err() != nil {
+		// stopped while sending, the attempt does not count
+		dbFrom(ctx).Model(delivery).Update("next_attempt_at", time.Now())
+		return
+	}
+	delivery.recordAttempt(statusCode, err)
+	switch delivery.Status {
+	case deliveryDelivered:
+		log.Info("Webhook delivered", "attempts", delivery.Attempts)
+	case deliveryFailed:
+		log.Error("Webhook delivery failed, giving up", "attempts", delivery.Attempts, "error", err)
+	default:
+		log.Warn("Webhook delivery failed, retrying", "attempts", delivery.Attempts, "retry_at", delivery.NextAttemptAt, "error", err)
+	}
+	if delivery.Event == webhookUserDeleted && delivery.Status != deliveryPending {
+		// the ids of an erased user are only kept until the receiver has them
+		dbFrom(ctx).Delete(delivery)
+		return
+	}
+	dbFrom(ctx).Save(delivery)
+}
+
+// recordAttempt sets the outcome of an attempt: delivered, failed after webhookMaxAttempts or due again after the backoff
+func (delivery *WebhookDelivery) recordAttempt(statusCode int, err error) {
+	delivery.Attempts++
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+
+	switch {
+	case err == nil:
+		now := time.Now()
+		delivery.Status = deliveryDelivered
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = deliveryFailed
+	default:
+		delivery.NextAttemptAt = time.Now().Add(webhookBackoff(delivery.Attempts))
+	}
+}
+
+// postWebhook sends the payload with its signature, any 2xx status counts as delivered
+func postWebhook(ctx context.Context, delivery *WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	request, err := http.NewRequest("POST", delivery.Url, bytes.NewReader(body))
+	handleError(err)
+
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Id", delivery.EventId)
+	request.Header.Set("X-Webhook-Event", delivery.Event)
+	if webhookSecret != "" {
+		request.Header.Set("X-Webhook-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, webhookSignature(timestamp, body)))
+	}
+
+	response, err := webhookClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, drainLimit))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook returned %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// FindWebhookDeliveries filters the delivery log by status and event, newest deliveries first
+func FindWebhookDeliveries(ctx context.Context, status, event string, limit, offset int) (deliveries []WebhookDelivery, total int) {
+	scope := dbFrom(ctx).Model(&WebhookDelivery{})
+	if status != "" {
+		scope = scope.Where("status = ?", status)
+	}
+	if event != "" {
+		scope = scope.Where("event = ?", event)
+	}
+	scope.Count(&total)
+	scope.Order("id DESC").Limit(limit).Offset(offset).Find(&deliveries)
+	return
+}
+
+// adminWebhookDeliveriesHandler lists the delivery log, newest first, filtered by status and event
+func adminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := queryInt(r, "limit", 50)
+	if limit == 0 || limit > maxAdminPageSize {
+		limit = maxAdminPageSize
+	}
+	offset := queryInt(r, "offset", 0)
+
+	deliveries, total := FindWebhookDeliveries(r.Context(), query.Get("status"), query.Get("event"), limit, offset)
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": deliveries, "total": total, "limit": limit, "offset": offset})
+}
+
+// adminWebhookTestHandler queues a ping event, to check the receivers and their signature verification
+func adminWebhookTestHandler(w http.ResponseWriter, r *http.Request) {
+	payload := webhookPayload{Id: fmt.Sprint(uuid.New()), Type: webhookPing, CreatedAt: time.Now().UTC()}
+	queueWebhook(r.Context(), payload, 0)
+	writeJSON(w, http.StatusAccepted, map[string]string{"id": payload.Id})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostWebhookSignsPayload(t *testing.T) {
+	webhookSecret = "test-secret"
+	defer func() { webhookSecret = "" }()
+
+	var signature, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Webhook-Signature")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer server.Close()
+
+	delivery := &WebhookDelivery{Url: server.URL, Event: webhookPing, EventId: "1", Payload: `{"type":"ping"}`}
+	if _, err := postWebhook(context.Background(), delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	var timestamp int64
+	var mac string
+	if _, err := fmt.Sscanf(strings.Replace(signature, ",", " ", 1), "t=%d v1=%s", &timestamp, &mac); err != nil {
+		t.Fatalf("malformed signature %q: %v", signature, err)
+	}
+	if body != delivery.Payload || mac != webhookSignature(timestamp, []byte(body)) {
+		t.Errorf("signature %q does not match the body %q", signature, body)
+	}
+}
+
+func TestWebhookDeliveryRetriesWithBackoff(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	delivery := &WebhookDelivery{Url: server.URL, Event: webhookPing, EventId: "1", Payload: "{}", Status: deliveryPending}
+	for attempt := 1; attempt <= 2; attempt++ {
+		delivery.recordAttempt(postWebhook(context.Background(), delivery))
+		if requests != attempt {
+			t.Fatalf("attempt %d sent %d requests, want one per attempt", attempt, requests)
+		}
+		if delivery.Status != deliveryPending || delivery.LastStatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("attempt %d: status %s, last status code %d", attempt, delivery.Status, delivery.LastStatusCode)
+		}
+		if wait := time.Until(delivery.NextAttemptAt); wait <= 0 || wait > webhookBackoff(attempt) {
+			t.Errorf("attempt %d: next attempt in %s, want %s", attempt, wait, webhookBackoff(attempt))
+		}
+	}
+
+	delivery.recordAttempt(postWebhook(context.Background(), delivery))
+	if delivery.Status != deliveryDelivered || delivery.Attempts != 3 || delivery.LastError != "" {
+		t.Errorf("got status %s after %d attempts, error %q", delivery.Status, delivery.Attempts, delivery.LastError)
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	delivery := &WebhookDelivery{Attempts: webhookMaxAttempts - 1, Status: deliveryPending}
+	delivery.recordAttempt(http.StatusInternalServerError, fmt.Errorf("webhook returned 500"))
+	if delivery.Status != deliveryFailed {
+		t.Errorf("got status %s after %d attempts, want %s", delivery.Status, delivery.Attempts, deliveryFailed)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 4: 80 * time.Second, 10: time.Hour, 40: time.Hour} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}